@@ -0,0 +1,395 @@
+package wtk
+
+import (
+	"container/list"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCacheRule enables response caching on a route.
+type ResponseCacheRule struct {
+	// TTL is how long a response is kept, ResponseCacheTTL is used when 0.
+	TTL time.Duration
+	// QueryParams selects the query parameters that are part of the cache key.
+	// The whole query string is used when it is nil.
+	QueryParams []string
+	// VaryHeaders are request headers whose values are part of the cache key.
+	VaryHeaders []string
+	// SessionKey adds the value of a session key to the cache key,
+	// so that responses can be cached per user.
+	SessionKey string
+	// Tags are attached to every response cached by the rule.
+	Tags []string
+}
+
+type CachedResponse struct {
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Tags    []string
+	Created time.Time
+	Expires time.Time
+	// Vary marks an entry that only lists the request headers of the Vary
+	// header of the response, the response is kept under its own key.
+	Vary []string
+}
+
+type ResponseCacheStorageInterface interface {
+	Get(key string) *CachedResponse
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+	DeleteTag(tag string)
+	Clear()
+}
+
+func (this *Route) Cache(rule *ResponseCacheRule) {
+	this.cache = rule
+}
+
+type wtkResponseCache struct {
+	storage ResponseCacheStorageInterface
+}
+
+func (this *wtkResponseCache) RegisterStorage(storage ResponseCacheStorageInterface) {
+	if storage == nil {
+		return
+	}
+	this.storage = storage
+}
+
+func (this *wtkResponseCache) Invalidate(tags ...string) {
+	for _, tag := range tags {
+		this.storage.DeleteTag(tag)
+	}
+}
+
+func (this *wtkResponseCache) key(r *http.Request, rule *ResponseCacheRule, session *Session) string {
+	var b strings.Builder
+	// HEAD requests are answered from the response of GET.
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	b.WriteString(method + " " + r.URL.Path)
+	b.WriteString("?")
+	query := r.URL.Query()
+	if rule.QueryParams != nil {
+		selected := make(url.Values)
+		for _, name := range rule.QueryParams {
+			if vs, ok := query[name]; ok {
+				selected[name] = vs
+			}
+		}
+		query = selected
+	}
+	b.WriteString(query.Encode())
+	for _, name := range rule.VaryHeaders {
+		b.WriteString("\n" + http.CanonicalHeaderKey(name) + ":" + r.Header.Get(name))
+	}
+	if rule.SessionKey != "" {
+		b.WriteString("\nsession:" + session.peek(rule.SessionKey))
+	}
+	return b.String()
+}
+
+// varyKey returns the part of the key of a response for the values of the
+// request headers it varies on.
+func varyKey(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("\nvary:" + name + ":" + strings.Join(r.Header[name], ","))
+	}
+	return b.String()
+}
+
+// responseVary returns the request headers of the Vary header of a response.
+// Accept-Encoding is left out as the cache compresses on its own, ok is false
+// for Vary: *.
+func responseVary(header http.Header) (names []string, ok bool) {
+	seen := make(map[string]bool)
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch name {
+			case "*":
+				return nil, false
+			case "", "Accept-Encoding":
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+type wtkCacheControl map[string]string
+
+func parseCacheControl(header http.Header) wtkCacheControl {
+	cc := make(wtkCacheControl)
+	for _, v := range header["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "" {
+				continue
+			}
+			if i := strings.Index(d, "="); i >= 0 {
+				cc[d[:i]] = strings.Trim(d[i+1:], `"`)
+			} else {
+				cc[d] = ""
+			}
+		}
+	}
+	if _, ok := cc["no-cache"]; !ok && header.Get("Pragma") == "no-cache" {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (this wtkCacheControl) has(directive string) bool {
+	_, ok := this[directive]
+	return ok
+}
+
+// serve writes a cached response and reports whether the request was answered.
+func (this *wtkResponseCache) serve(w *wtkResponseWriter, r *http.Request, key string, cc wtkCacheControl) bool {
+	if cc.has("no-cache") || cc.has("no-store") {
+		return false
+	}
+	resp := this.storage.Get(key)
+	if resp != nil && len(resp.Vary) > 0 {
+		resp = this.storage.Get(key + varyKey(r, resp.Vary))
+	}
+	if resp == nil || time.Now().After(resp.Expires) {
+		if cc.has("only-if-cached") {
+			w.gzipWriter = nil
+			w.writer.WriteHeader(http.StatusGatewayTimeout)
+			w.Close()
+			return true
+		}
+		return false
+	}
+	age := int64(time.Since(resp.Created) / time.Second)
+	if v, ok := cc["max-age"]; ok {
+		if maxAge, err := strconv.ParseInt(v, 10, 64); err == nil && age > maxAge {
+			return false
+		}
+	}
+	if v, ok := cc["min-fresh"]; ok {
+		if minFresh, err := strconv.ParseInt(v, 10, 64); err == nil && time.Now().Add(time.Duration(minFresh)*time.Second).After(resp.Expires) {
+			return false
+		}
+	}
+
+	header := w.Header()
+	for name, values := range resp.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.FormatInt(age, 10))
+	w.Finished = true
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, etag) {
+			header.Del("Content-Type")
+			w.gzipWriter = nil
+			w.writer.WriteHeader(http.StatusNotModified)
+			w.Close()
+			return true
+		}
+	}
+	if EnableGzip && len(resp.Body) < GzipMinLength {
+		w.gzipWriter = nil
+	}
+	if resp.Status != 0 && resp.Status != http.StatusOK {
+		w.httpStatus = resp.Status
+	}
+	w.Write(resp.Body)
+	w.Close()
+	return true
+}
+
+// store saves the recorded response if it is cacheable.
+func (this *wtkResponseCache) store(w *wtkResponseWriter, key string, rule *ResponseCacheRule, ctx *Context) {
+	if w.recorder == nil {
+		return
+	}
+	if w.status != 0 && w.status != http.StatusOK {
+		return
+	}
+	// An empty 200 is more likely a failed render than a page.
+	if w.recorder.Len() == 0 {
+		return
+	}
+	header := w.Header()
+	if len(header["Set-Cookie"]) > 0 {
+		return
+	}
+	// The session was changed after the headers were sent, its cookie is
+	// not part of the response.
+	if ctx.hdlr.Session.dirty {
+		return
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return
+	}
+	vary, ok := responseVary(header)
+	if !ok {
+		return
+	}
+	stored := make(http.Header)
+	for name, values := range header {
+		switch name {
+		case "Content-Encoding", "Content-Length", "Age":
+			continue
+		}
+		stored[name] = append([]string(nil), values...)
+	}
+	ttl := rule.TTL
+	if ttl <= 0 {
+		ttl = time.Duration(ResponseCacheTTL) * time.Second
+	}
+	now := time.Now()
+	resp := &CachedResponse{
+		Status:  http.StatusOK,
+		Header:  stored,
+		Body:    w.recorder.Bytes(),
+		Tags:    append(append([]string{}, rule.Tags...), ctx.cacheTags...),
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	if len(vary) > 0 {
+		this.storage.Set(key, &CachedResponse{Tags: resp.Tags, Created: now, Expires: resp.Expires, Vary: vary})
+		key += varyKey(w.request, vary)
+	}
+	this.storage.Set(key, resp)
+}
+
+// AddCacheTag attaches tags to the response of this request if it is cached,
+// so that it can be dropped later by Server.InvalidateResponseCache.
+func (this *Context) AddCacheTag(tags ...string) {
+	this.cacheTags = append(this.cacheTags, tags...)
+}
+
+// DisableCache prevents the response of this request from being cached.
+func (this *Context) DisableCache() {
+	this.response.recorder = nil
+}
+
+type wtkMemoryResponseCacheEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// MemoryResponseCache is an in-memory LRU response cache storage.
+type MemoryResponseCache struct {
+	lock     sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+	tags     map[string]map[string]bool
+}
+
+// NewMemoryResponseCache creates a storage that holds at most capacity
+// responses, the least recently used is evicted first.
+func NewMemoryResponseCache(capacity int) *MemoryResponseCache {
+	return &MemoryResponseCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		tags:     make(map[string]map[string]bool),
+	}
+}
+
+func (this *MemoryResponseCache) Get(key string) *CachedResponse {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e, ok := this.items[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*wtkMemoryResponseCacheEntry)
+	if time.Now().After(entry.resp.Expires) {
+		this.remove(e)
+		return nil
+	}
+	this.order.MoveToFront(e)
+	return entry.resp
+}
+
+func (this *MemoryResponseCache) Set(key string, resp *CachedResponse) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if e, ok := this.items[key]; ok {
+		this.remove(e)
+	}
+	e := this.order.PushFront(&wtkMemoryResponseCacheEntry{key: key, resp: resp})
+	this.items[key] = e
+	for _, tag := range resp.Tags {
+		if this.tags[tag] == nil {
+			this.tags[tag] = make(map[string]bool)
+		}
+		this.tags[tag][key] = true
+	}
+	for this.capacity > 0 && this.order.Len() > this.capacity {
+		this.remove(this.order.Back())
+	}
+}
+
+func (this *MemoryResponseCache) Delete(key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if e, ok := this.items[key]; ok {
+		this.remove(e)
+	}
+}
+
+func (this *MemoryResponseCache) DeleteTag(tag string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for key := range this.tags[tag] {
+		if e, ok := this.items[key]; ok {
+			this.remove(e)
+		}
+	}
+	delete(this.tags, tag)
+}
+
+func (this *MemoryResponseCache) Clear() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.items = make(map[string]*list.Element)
+	this.order.Init()
+	this.tags = make(map[string]map[string]bool)
+}
+
+func (this *MemoryResponseCache) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.order.Len()
+}
+
+func (this *MemoryResponseCache) remove(e *list.Element) {
+	entry := this.order.Remove(e).(*wtkMemoryResponseCacheEntry)
+	delete(this.items, entry.key)
+	for _, tag := range entry.resp.Tags {
+		if keys, ok := this.tags[tag]; ok {
+			delete(keys, entry.key)
+			if len(keys) == 0 {
+				delete(this.tags, tag)
+			}
+		}
+	}
+}
@@ -48,21 +48,56 @@ func (this *wtkConfig) loadConfig(cfg interface{}) error {
 }
 
 type wtkDefaultConfig struct {
-	AppRoot           string
-	ListenAddr        string
-	ListenPort        int
-	RunMode           string
-	EnableStats       bool
-	CookieSecret      string
-	SessionName       string
-	SessionTTL        int64
-	EnablePprof       bool
-	EnableGzip        bool
-	EnableRouteCache  bool
-	GzipMinLength     int
-	GzipTypes         []string
-	SslCertificate    string
-	SslCertificateKey string
+	AppRoot                 string
+	ListenAddr              string
+	ListenPort              int
+	RunMode                 string
+	EnableStats             bool
+	CookieSecret            string
+	SessionName             string
+	SessionTTL              int64
+	EnablePprof             bool
+	EnableGzip              bool
+	EnableRouteCache        bool
+	GzipMinLength           int
+	GzipTypes               []string
+	SslCertificate          string
+	SslCertificateKey       string
+	WebSocketMaxMessageSize int64
+	WebSocketAllowedOrigins []string
+	EnableETag              bool
+	ResponseCacheSize       int
+	ResponseCacheTTL        int64
+	AppEnv                  string
+	CookieOldSecrets        []string
+	CookieBindUserAgent     bool
+	CookieBindIP            bool
+	CookieAllowLegacy       bool
+	CookiePath              string
+	CookieDomain            string
+	CookieSecure            bool
+	CookieHttpOnly          bool
+	CookieSameSite          string
+	CookiePartitioned       bool
+	SessionMaxLifetime      int64
+	SessionGCInterval       int64
+	SessionMaxCount         int
+	SessionFileDir          string
+	SessionFailurePolicy    string
+	EnableCsrf              bool
+	CsrfMode                string
+	CsrfFieldName           string
+	CsrfHeaderName          string
+	CsrfCookieName          string
+	CsrfTrustedOrigins      []string
+	TemplateDir             string
+	TemplateExtensions      []string
+	FragmentHeader          string
+	I18nDir                 string
+	DefaultLocale           string
+	LocaleCookieName        string
+	LocaleQueryParam        string
+	EnableLocalePath        bool
 }
 
 func (this *wtkDefaultConfig) OnLoaded() {
@@ -81,4 +116,40 @@ func (this *wtkDefaultConfig) OnLoaded() {
 	GzipTypes = this.GzipTypes
 	SslCertificate = this.SslCertificate
 	SslCertificateKey = this.SslCertificateKey
+	WebSocketMaxMessageSize = this.WebSocketMaxMessageSize
+	WebSocketAllowedOrigins = this.WebSocketAllowedOrigins
+	EnableETag = this.EnableETag
+	ResponseCacheSize = this.ResponseCacheSize
+	ResponseCacheTTL = this.ResponseCacheTTL
+	AppEnv = this.AppEnv
+	CookieOldSecrets = this.CookieOldSecrets
+	CookieBindUserAgent = this.CookieBindUserAgent
+	CookieBindIP = this.CookieBindIP
+	CookieAllowLegacy = this.CookieAllowLegacy
+	CookiePath = this.CookiePath
+	CookieDomain = this.CookieDomain
+	CookieSecure = this.CookieSecure
+	CookieHttpOnly = this.CookieHttpOnly
+	CookieSameSite = this.CookieSameSite
+	CookiePartitioned = this.CookiePartitioned
+	SessionMaxLifetime = this.SessionMaxLifetime
+	SessionGCInterval = this.SessionGCInterval
+	SessionMaxCount = this.SessionMaxCount
+	SessionFileDir = this.SessionFileDir
+	SessionFailurePolicy = this.SessionFailurePolicy
+	EnableCsrf = this.EnableCsrf
+	CsrfMode = this.CsrfMode
+	CsrfFieldName = this.CsrfFieldName
+	CsrfHeaderName = this.CsrfHeaderName
+	CsrfCookieName = this.CsrfCookieName
+	CsrfTrustedOrigins = this.CsrfTrustedOrigins
+	TemplateDir = this.TemplateDir
+	TemplateExtensions = this.TemplateExtensions
+	FragmentHeader = this.FragmentHeader
+	I18nDir = this.I18nDir
+	DefaultLocale = this.DefaultLocale
+	LocaleCookieName = this.LocaleCookieName
+	LocaleQueryParam = this.LocaleQueryParam
+	EnableLocalePath = this.EnableLocalePath
+	cookieKeys()
 }
@@ -2,17 +2,15 @@ package wtk
 
 import (
 	"bufio"
-	"encoding/base64"
 	"errors"
 	"io"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
-	"time"
 )
 
 type Context struct {
@@ -23,6 +21,10 @@ type Context struct {
 	pathVars       url.Values
 	queryVars      url.Values
 	formVars       url.Values
+	eventStream    *EventStream
+	webSocket      *WebSocketConn
+	cacheTags      []string
+	csrfSecret     []byte
 }
 
 func (this *Context) GetPathVar(name string) string {
@@ -104,22 +106,37 @@ func (this *Context) finish() {
 	this.response.Close()
 }
 
+// close releases resources that may outlive the handler method,
+// it is called when the request is done.
+func (this *Context) close() {
+	this.hdlr.Session.flush()
+	if this.eventStream != nil {
+		this.eventStream.Close()
+	}
+	if this.webSocket != nil {
+		this.webSocket.Close(WebSocketCloseGoingAway, "")
+	}
+}
+
 func (this *Context) WriteString(content string) {
 	this.WriteBytes([]byte(content))
 }
 
 func (this *Context) WriteBytes(content []byte) {
-	if this.response.Closed {
+	if this.response.isClosed() {
 		return
 	}
 	this.hdlr.callHandlerHook("BeforeOutput")
 	if this.response.Finished {
 		return
 	}
-	this.SetHeader("Content-Type", http.DetectContentType(content))
 	if EnableGzip && len(content) < GzipMinLength {
 		this.response.gzipWriter = nil
 	}
+	if this.etagEnabled() && this.checkETag(content) {
+		return
+	}
+	this.SetHeader("Content-Type", http.DetectContentType(content))
 	this.response.Write(content)
 
 	this.hdlr.callHandlerHook("AfterOutput")
@@ -152,6 +169,8 @@ func (this *Context) RedirectUrl(url string) {
 }
 
 func (this *Context) NotModified() {
+	this.response.Header().Del("Content-Type")
+	this.response.Header().Del("Content-Length")
 	this.response.WriteHeader(304)
 	this.finish()
 }
@@ -161,6 +180,15 @@ func (this *Context) NotFound() {
 	this.finish()
 }
 
+// remoteIP returns the IP address of the client without the port.
+func (this *Context) remoteIP() string {
+	ip, _, err := net.SplitHostPort(this.Request.RemoteAddr)
+	if err != nil {
+		return this.Request.RemoteAddr
+	}
+	return ip
+}
+
 func (this *Context) SetHeader(name string, value string) {
 	this.response.Header().Set(name, value)
 }
@@ -183,27 +211,19 @@ func (this *Context) SetContentType(ext string) {
 
 //Sets a cookie -- duration is the amount of time in seconds. 0 = browser
 func (this *Context) SetCookieWithArgs(name string, value string, maxage int, path string, domain string, secure bool, httponly bool) {
-	cookie := &http.Cookie{
-		Name:     name,
-		Value:    value,
-		Path:     path,
-		Domain:   domain,
-		Secure:   secure,
-		HttpOnly: httponly,
-	}
-	if maxage > 0 {
-		d := time.Duration(maxage) * time.Second
-		cookie.Expires = time.Now().Add(d)
-		cookie.MaxAge = maxage
-	}
-	if path == "" && this.hdlr.server.router.PrefixPath != "" {
-		cookie.Path = this.hdlr.server.router.PrefixPath
-	}
-	http.SetCookie(this.response, cookie)
+	options := NewCookieOptions()
+	options.MaxAge = maxage
+	options.Path = path
+	options.Domain = domain
+	options.Secure = secure
+	options.HttpOnly = httponly
+	this.SetCookieWithOptions(name, value, options)
 }
 
 func (this *Context) SetCookie(name string, value string, maxage int) {
-	this.SetCookieWithArgs(name, value, maxage, "", "", false, false)
+	options := NewCookieOptions()
+	options.MaxAge = maxage
+	this.SetCookieWithOptions(name, value, options)
 }
 
 func (this *Context) GetCookie(name string) string {
@@ -215,62 +235,29 @@ func (this *Context) GetCookie(name string) string {
 }
 
 func (this *Context) SetSecureCookieWithArgs(name string, value string, maxage int, path string, domain string, secure bool, httponly bool) {
-	ts := "0"
-	if maxage > 0 {
-		d := time.Duration(maxage) * time.Second
-		t := time.Now().Add(d)
-		ts = strconv.FormatInt(t.Unix(), 10)
-	}
-	text := name + value + ts
-	text += this.Request.UserAgent()
-
-	sig := util.getCookieSig(CookieSecret, text)
-	val := base64.URLEncoding.EncodeToString(util.AesEncrypt([]byte(CookieSecret), []byte(ts+"|"+value)))
-
-	this.SetCookieWithArgs(name, sig+"|"+val, maxage, path, domain, secure, httponly)
+	this.SetCookieWithArgs(name, this.encodeSecureCookie(name, value, maxage), maxage, path, domain, secure, httponly)
 }
 
 func (this *Context) SetSecureCookie(name string, value string, maxage int) {
-	this.SetSecureCookieWithArgs(name, value, maxage, "", "", false, true)
+	options := NewCookieOptions()
+	options.MaxAge = maxage
+	options.HttpOnly = true
+	this.SetSecureCookieWithOptions(name, value, options)
 }
 
 func (this *Context) GetSecureCookie(name string) string {
+	value, _ := this.getSecureCookie(name)
+	return value
+}
+
+// getSecureCookie also reports whether the cookie is in the legacy format,
+// so that callers can issue it again in the current format.
+func (this *Context) getSecureCookie(name string) (string, bool) {
 	str := this.GetCookie(name)
 	if str == "" {
-		return ""
-	}
-	strs := strings.SplitN(str, "|", 2)
-	if len(strs) != 2 {
-		return ""
-	}
-	sig := strs[0]
-	val := strs[1]
-	b, err := base64.URLEncoding.DecodeString(val)
-	if err != nil {
-		return ""
-	}
-	decrypted := string(util.AesDecrypt([]byte(CookieSecret), b))
-	if decrypted == "" {
-		return ""
+		return "", false
 	}
-	parts := strings.SplitN(decrypted, "|", 2)
-	if len(parts) != 2 {
-		return ""
-	}
-	ts := parts[0]
-	value := parts[1]
-
-	text := name + value + ts
-	text += this.Request.UserAgent()
-
-	if util.getCookieSig(CookieSecret, text) != sig {
-		return ""
-	}
-	expires, err := strconv.ParseInt(ts, 0, 64)
-	if err != nil || expires > 0 && time.Now().Unix() > expires {
-		return ""
-	}
-	return value
+	return this.decodeSecureCookie(name, str)
 }
 
 func (this *Context) GetUploadFile(name string) (*UploadFile, error) {
@@ -0,0 +1,114 @@
+package wtk
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+type CookieOptions struct {
+	// MaxAge is the lifetime in seconds, 0 means a browser session cookie
+	// and a negative value deletes the cookie.
+	MaxAge   int
+	Path     string
+	Domain   string
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+	// Partitioned puts the cookie in partitioned storage (CHIPS).
+	Partitioned bool
+}
+
+// NewCookieOptions returns the server-wide cookie defaults from the config.
+func NewCookieOptions() *CookieOptions {
+	return &CookieOptions{
+		Path:        CookiePath,
+		Domain:      CookieDomain,
+		Secure:      CookieSecure,
+		HttpOnly:    CookieHttpOnly,
+		SameSite:    parseSameSite(CookieSameSite),
+		Partitioned: CookiePartitioned,
+	}
+}
+
+func parseSameSite(s string) http.SameSite {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return 0
+}
+
+// enforce adjusts the options to what browsers require for the cookie name
+// prefixes and attributes, otherwise the cookie would be silently dropped.
+func (this *CookieOptions) enforce(name string) {
+	if strings.HasPrefix(name, "__Secure-") {
+		this.Secure = true
+	}
+	if strings.HasPrefix(name, "__Host-") {
+		this.Secure = true
+		this.Path = "/"
+		this.Domain = ""
+	}
+	if this.SameSite == http.SameSiteNoneMode || this.Partitioned {
+		this.Secure = true
+	}
+}
+
+func (this *Context) SetCookieWithOptions(name string, value string, options *CookieOptions) {
+	if options == nil {
+		options = NewCookieOptions()
+	}
+	opts := *options
+	if opts.Path == "" && this.hdlr.server.router.PrefixPath != "" {
+		opts.Path = this.hdlr.server.router.PrefixPath
+	}
+	opts.enforce(name)
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     opts.Path,
+		Domain:   opts.Domain,
+		Secure:   opts.Secure,
+		HttpOnly: opts.HttpOnly,
+		SameSite: opts.SameSite,
+	}
+	if opts.MaxAge > 0 {
+		d := time.Duration(opts.MaxAge) * time.Second
+		cookie.Expires = time.Now().Add(d)
+		cookie.MaxAge = opts.MaxAge
+	} else if opts.MaxAge < 0 {
+		cookie.Expires = time.Unix(1, 0)
+		cookie.MaxAge = -1
+	}
+	v := cookie.String()
+	if v == "" {
+		return
+	}
+	if opts.Partitioned {
+		v += "; Partitioned"
+	}
+	this.response.Header().Add("Set-Cookie", v)
+}
+
+func (this *Context) SetSecureCookieWithOptions(name string, value string, options *CookieOptions) {
+	if options == nil {
+		options = NewCookieOptions()
+	}
+	this.SetCookieWithOptions(name, this.encodeSecureCookie(name, value, options.MaxAge), options)
+}
+
+// DeleteCookie expires the cookie on the client. The path and domain in the
+// options must match the ones the cookie was set with, nil uses the defaults.
+func (this *Context) DeleteCookie(name string, options *CookieOptions) {
+	if options == nil {
+		options = NewCookieOptions()
+	}
+	opts := *options
+	opts.MaxAge = -1
+	this.SetCookieWithOptions(name, "", &opts)
+}
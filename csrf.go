@@ -0,0 +1,160 @@
+package wtk
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// CsrfModeSession keeps the token in the session.
+	CsrfModeSession = "session"
+	// CsrfModeCookie keeps the token in a signed cookie and compares it with
+	// the submitted one, so it works without a session (double submit).
+	CsrfModeCookie = "cookie"
+)
+
+const (
+	csrfSessionKey = "_csrf"
+	csrfTokenSize  = 32
+)
+
+// Csrf overrides the global EnableCsrf setting for this route,
+// Csrf(false) lets an endpoint such as a webhook accept foreign posts.
+func (this *Route) Csrf(enable bool) {
+	if enable {
+		this.csrf = 1
+	} else {
+		this.csrf = -1
+	}
+}
+
+// csrfHook runs before the handler methods of unsafe requests and rejects
+// them with 403, which goes through the HttpStatus403 hook.
+func csrfHook(h *HookHandler) {
+	ctx := h.Context
+	if !ctx.csrfEnabled() {
+		return
+	}
+	if !ctx.checkCsrfOrigin() || !ctx.checkCsrfToken() {
+		ctx.Abort(http.StatusForbidden, "Forbidden")
+	}
+}
+
+func (this *Context) csrfEnabled() bool {
+	if route := this.hdlr.route; route != nil && route.csrf != 0 {
+		return route.csrf > 0
+	}
+	return EnableCsrf
+}
+
+// checkCsrfOrigin rejects requests whose Origin, or Referer when there is no
+// Origin, is neither the requested host nor in CsrfTrustedOrigins.
+// Requests carrying neither header are left to the token check.
+func (this *Context) checkCsrfOrigin() bool {
+	source := this.Request.Header.Get("Origin")
+	if source == "" {
+		source = this.Request.Header.Get("Referer")
+		if source == "" {
+			return true
+		}
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, this.Request.Host) {
+		return true
+	}
+	origin := u.Scheme + "://" + u.Host
+	for _, o := range CsrfTrustedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Context) checkCsrfToken() bool {
+	token := this.getCsrfSecret(false)
+	if token == nil {
+		return false
+	}
+	submitted := this.Request.Header.Get(CsrfHeaderName)
+	if submitted == "" {
+		submitted = this.GetFormVar(CsrfFieldName)
+	}
+	return subtle.ConstantTimeCompare(unmaskCsrfToken(submitted), token) == 1
+}
+
+// getCsrfSecret returns the token of the client, a new one is issued
+// when there is none and create is true.
+func (this *Context) getCsrfSecret(create bool) []byte {
+	if this.csrfSecret != nil {
+		return this.csrfSecret
+	}
+	var str string
+	if CsrfMode == CsrfModeCookie {
+		str = this.GetSecureCookie(CsrfCookieName)
+	} else if create {
+		str = this.hdlr.Session.Get(csrfSessionKey)
+	} else {
+		str = this.hdlr.Session.peek(csrfSessionKey)
+	}
+	token, err := base64.RawURLEncoding.DecodeString(str)
+	if err == nil && len(token) == csrfTokenSize {
+		this.csrfSecret = token
+		return token
+	}
+	if !create {
+		return nil
+	}
+	str = util.randomId(csrfTokenSize)
+	if CsrfMode == CsrfModeCookie {
+		options := NewCookieOptions()
+		options.HttpOnly = true
+		this.SetSecureCookieWithOptions(CsrfCookieName, str, options)
+	} else {
+		this.hdlr.Session.Set(csrfSessionKey, str)
+	}
+	this.csrfSecret, _ = base64.RawURLEncoding.DecodeString(str)
+	return this.csrfSecret
+}
+
+// CsrfToken returns the token to send with unsafe requests, in the
+// CsrfFieldName form field or the CsrfHeaderName header. The token is masked
+// with a random pad on every call so that it does not repeat in responses.
+func (this *Context) CsrfToken() string {
+	token := this.getCsrfSecret(true)
+	pad := make([]byte, csrfTokenSize)
+	if _, err := rand.Read(pad); err != nil {
+		panic(err)
+	}
+	masked := make([]byte, 2*csrfTokenSize)
+	copy(masked, pad)
+	for i := range token {
+		masked[csrfTokenSize+i] = pad[i] ^ token[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(masked)
+}
+
+func unmaskCsrfToken(str string) []byte {
+	masked, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil || len(masked) != 2*csrfTokenSize {
+		return nil
+	}
+	token := make([]byte, csrfTokenSize)
+	for i := range token {
+		token[i] = masked[i] ^ masked[csrfTokenSize+i]
+	}
+	return token
+}
+
+// CsrfField returns a hidden input holding the token.
+func (this *Context) CsrfField() template.HTML {
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(CsrfFieldName) + `" value="` + this.CsrfToken() + `">`)
+}
@@ -0,0 +1,77 @@
+package wtk
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (this *Context) etagEnabled() bool {
+	if this.Request.Method != "GET" && this.Request.Method != "HEAD" {
+		return false
+	}
+	if this.response.status != 0 && this.response.status != http.StatusOK {
+		return false
+	}
+	if route := this.hdlr.route; route != nil && route.etag != 0 {
+		return route.etag > 0
+	}
+	return EnableETag
+}
+
+// checkETag sets the ETag header of the response and reports whether
+// the request's validators match, in which case a 304 has been sent.
+// A weak ETag is used when the content is gzipped because the encoded
+// bytes are not guaranteed to be identical between responses.
+func (this *Context) checkETag(content []byte) bool {
+	etag := this.response.Header().Get("ETag")
+	if etag == "" {
+		sum := sha1.Sum(content)
+		etag = `"` + hex.EncodeToString(sum[:]) + `"`
+		if this.response.gzipWriter != nil {
+			etag = "W/" + etag
+		}
+		this.SetHeader("ETag", etag)
+	}
+
+	if inm := this.Request.Header.Get("If-None-Match"); inm != "" {
+		if etagMatch(inm, etag) {
+			this.NotModified()
+			return true
+		}
+		return false
+	}
+
+	ims := this.Request.Header.Get("If-Modified-Since")
+	lm := this.response.Header().Get("Last-Modified")
+	if ims != "" && lm != "" {
+		imsTime, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lmTime, err := http.ParseTime(lm)
+		if err != nil {
+			return false
+		}
+		if !lmTime.Truncate(time.Second).After(imsTime) {
+			this.NotModified()
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatch uses the weak comparison of RFC 7232, which is what
+// If-None-Match requires.
+func etagMatch(header string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
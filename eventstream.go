@@ -0,0 +1,171 @@
+package wtk
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrEventStreamClosed = errors.New("event stream is closed")
+
+type Event struct {
+	Id    string
+	Event string
+	Data  string
+	// Retry is the reconnection time in milliseconds, 0 means not set.
+	Retry int
+}
+
+type EventStream struct {
+	ctx         *Context
+	lock        sync.Mutex
+	done        chan struct{}
+	closeOnce   sync.Once
+	LastEventId string
+}
+
+// EventStream switches the response to text/event-stream and returns a sender
+// for Server-Sent Events. The handler should keep sending until Done is closed,
+// the normal Render and Output steps are skipped once the stream is opened.
+func (this *Context) EventStream() (*EventStream, error) {
+	if _, ok := this.response.writer.(http.Flusher); !ok {
+		return nil, errors.New("streaming is not supported by the response writer")
+	}
+	if this.response.isClosed() {
+		return nil, ErrEventStreamClosed
+	}
+	this.response.gzipWriter = nil
+	this.response.recorder = nil
+	this.SetHeader("Content-Type", "text/event-stream; charset=utf-8")
+	this.SetHeader("Cache-Control", "no-cache")
+	this.SetHeader("Connection", "keep-alive")
+	this.SetHeader("X-Accel-Buffering", "no")
+	this.response.Header().Del("Content-Length")
+	this.response.WriteHeader(http.StatusOK)
+	if this.response.isClosed() {
+		return nil, ErrEventStreamClosed
+	}
+	this.response.Finished = true
+	this.response.Flush()
+
+	es := &EventStream{
+		ctx:         this,
+		done:        make(chan struct{}),
+		LastEventId: this.Request.Header.Get("Last-Event-ID"),
+	}
+	if es.LastEventId == "" {
+		es.LastEventId = this.GetQueryVar("lastEventId")
+	}
+	this.eventStream = es
+	go func() {
+		select {
+		case <-this.Request.Context().Done():
+			es.Close()
+		case <-es.done:
+		}
+	}()
+	return es, nil
+}
+
+func (this *EventStream) write(s string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	select {
+	case <-this.done:
+		return ErrEventStreamClosed
+	default:
+	}
+	_, err := this.ctx.response.Write([]byte(s))
+	if err != nil {
+		this.close()
+		return err
+	}
+	this.ctx.response.Flush()
+	return nil
+}
+
+func (this *EventStream) Send(event *Event) error {
+	var b strings.Builder
+	if event.Id != "" {
+		b.WriteString("id: " + cleanEventField(event.Id) + "\n")
+	}
+	if event.Event != "" {
+		b.WriteString("event: " + cleanEventField(event.Event) + "\n")
+	}
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.Itoa(event.Retry) + "\n")
+	}
+	data := strings.Replace(event.Data, "\r\n", "\n", -1)
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return this.write(b.String())
+}
+
+func (this *EventStream) SendData(data string) error {
+	return this.Send(&Event{Data: data})
+}
+
+func (this *EventStream) SendEvent(event string, data string) error {
+	return this.Send(&Event{Event: event, Data: data})
+}
+
+// SetRetry tells the client how many milliseconds to wait before reconnecting.
+func (this *EventStream) SetRetry(ms int) error {
+	return this.write("retry: " + strconv.Itoa(ms) + "\n\n")
+}
+
+func (this *EventStream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return this.write(b.String())
+}
+
+// Heartbeat sends a comment line every interval to keep proxies from
+// dropping an idle connection. It stops when the stream is closed.
+func (this *EventStream) Heartbeat(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-this.done:
+				return
+			case <-ticker.C:
+				if this.Comment("heartbeat") != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Done is closed when the client disconnects or Close is called.
+func (this *EventStream) Done() <-chan struct{} {
+	return this.done
+}
+
+func (this *EventStream) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.close()
+}
+
+func (this *EventStream) close() {
+	this.closeOnce.Do(func() {
+		close(this.done)
+		this.ctx.response.Close()
+	})
+}
+
+func cleanEventField(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
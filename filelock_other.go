@@ -0,0 +1,25 @@
+//go:build !unix
+
+package wtk
+
+import (
+	"os"
+	"sync"
+)
+
+// Without flock the lock only works within the process,
+// and shared locks are taken as exclusive ones.
+var fileLocks sync.Map
+
+func lockFile(f *os.File, exclusive bool) error {
+	l, _ := fileLocks.LoadOrStore(f.Name(), new(sync.Mutex))
+	l.(*sync.Mutex).Lock()
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	if l, ok := fileLocks.Load(f.Name()); ok {
+		l.(*sync.Mutex).Unlock()
+	}
+	return nil
+}
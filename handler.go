@@ -23,6 +23,7 @@ type HandlerInterface interface {
 
 type Handler struct {
 	server   *Server
+	route    *Route
 	Context  *Context
 	Template *Template
 	Session  *Session
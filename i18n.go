@@ -0,0 +1,746 @@
+package wtk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wtkMessage is a message of a catalog, plural messages have a form for
+// each plural category such as "one" and "other".
+type wtkMessage struct {
+	text   string
+	plural map[string]string
+}
+
+var pluralCategories = map[string]bool{"zero": true, "one": true, "two": true, "few": true, "many": true, "other": true}
+
+var (
+	pluralRules = map[string]func(n float64) string{
+		"fr": pluralRuleFrench,
+		"pt": pluralRuleFrench,
+		"ru": pluralRuleSlavic,
+		"uk": pluralRuleSlavic,
+		"be": pluralRuleSlavic,
+		"pl": pluralRulePolish,
+		"cs": pluralRuleCzech,
+		"sk": pluralRuleCzech,
+		"ar": pluralRuleArabic,
+		"ja": pluralRuleNone,
+		"zh": pluralRuleNone,
+		"ko": pluralRuleNone,
+		"vi": pluralRuleNone,
+		"th": pluralRuleNone,
+		"id": pluralRuleNone,
+	}
+	pluralRulesLock sync.RWMutex
+)
+
+// RegisterPluralRule sets the plural rule of a language such as "fr". The
+// rule returns the plural category of n. Languages without a rule use
+// "one" for 1 and "other" for the rest.
+func RegisterPluralRule(lang string, rule func(n float64) string) {
+	pluralRulesLock.Lock()
+	defer pluralRulesLock.Unlock()
+	pluralRules[strings.ToLower(lang)] = rule
+}
+
+func pluralCategory(locale string, n float64) string {
+	lang := locale
+	if i := strings.IndexByte(lang, '-'); i > 0 {
+		lang = lang[:i]
+	}
+	pluralRulesLock.RLock()
+	rule, ok := pluralRules[lang]
+	pluralRulesLock.RUnlock()
+	if ok {
+		return rule(n)
+	}
+	if n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+func pluralRuleNone(n float64) string {
+	return "other"
+}
+
+func pluralRuleFrench(n float64) string {
+	if n >= 0 && n < 2 {
+		return "one"
+	}
+	return "other"
+}
+
+func pluralRuleSlavic(n float64) string {
+	if n != float64(int64(n)) {
+		return "other"
+	}
+	i := int64(n)
+	switch {
+	case i%10 == 1 && i%100 != 11:
+		return "one"
+	case i%10 >= 2 && i%10 <= 4 && (i%100 < 12 || i%100 > 14):
+		return "few"
+	}
+	return "many"
+}
+
+func pluralRulePolish(n float64) string {
+	if n != float64(int64(n)) {
+		return "other"
+	}
+	i := int64(n)
+	switch {
+	case i == 1:
+		return "one"
+	case i%10 >= 2 && i%10 <= 4 && (i%100 < 12 || i%100 > 14):
+		return "few"
+	}
+	return "many"
+}
+
+func pluralRuleCzech(n float64) string {
+	switch {
+	case n == 1:
+		return "one"
+	case n >= 2 && n <= 4 && n == float64(int64(n)):
+		return "few"
+	case n != float64(int64(n)):
+		return "many"
+	}
+	return "other"
+}
+
+func pluralRuleArabic(n float64) string {
+	i := int64(n)
+	switch {
+	case n == 0:
+		return "zero"
+	case n == 1:
+		return "one"
+	case n == 2:
+		return "two"
+	case n != float64(i):
+		return "other"
+	case i%100 >= 3 && i%100 <= 10:
+		return "few"
+	case i%100 >= 11:
+		return "many"
+	}
+	return "other"
+}
+
+// canonicalLocale returns a locale tag in lower case with dashes, such as pt-br.
+func canonicalLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+type wtkCatalog struct {
+	name     string
+	messages map[string]*wtkMessage
+}
+
+// wtkI18n holds the message catalogs of a directory, one file for each
+// locale named by the locale, such as fr.json or pt-BR.toml.
+type wtkI18n struct {
+	lock        sync.RWMutex
+	dir         string
+	catalogs    map[string]*wtkCatalog
+	modTimes    map[string]time.Time
+	checked     time.Time
+	missing     map[string]map[string]bool
+	missingLock sync.Mutex
+}
+
+func newI18n() *wtkI18n {
+	return &wtkI18n{
+		catalogs: make(map[string]*wtkCatalog),
+		modTimes: make(map[string]time.Time),
+		missing:  make(map[string]map[string]bool),
+	}
+}
+
+func i18nFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".json" || ext == ".toml"
+}
+
+// Load reads the catalogs of dir.
+func (this *wtkI18n) Load(dir string) error {
+	dir = templateDirPath(dir)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	catalogs := make(map[string]*wtkCatalog)
+	modTimes := make(map[string]time.Time)
+	for _, info := range infos {
+		if info.IsDir() || !i18nFile(info.Name()) {
+			continue
+		}
+		filename := filepath.Join(dir, info.Name())
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var data map[string]interface{}
+		if strings.EqualFold(filepath.Ext(filename), ".json") {
+			err = json.Unmarshal(content, &data)
+		} else {
+			data, err = parseTOML(string(content))
+		}
+		if err != nil {
+			return fmt.Errorf("i18n: %s: %v", info.Name(), err)
+		}
+		name := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		catalog := &wtkCatalog{name: name, messages: make(map[string]*wtkMessage)}
+		if err := catalog.add("", data); err != nil {
+			return fmt.Errorf("i18n: %s: %v", info.Name(), err)
+		}
+		catalogs[canonicalLocale(name)] = catalog
+		modTimes[info.Name()] = info.ModTime()
+	}
+
+	this.lock.Lock()
+	this.dir = dir
+	this.catalogs = catalogs
+	this.modTimes = modTimes
+	this.checked = time.Now()
+	this.lock.Unlock()
+	return nil
+}
+
+// add flattens nested tables to dotted keys. A table whose keys are all
+// plural categories is a plural message.
+func (this *wtkCatalog) add(prefix string, data map[string]interface{}) error {
+	for key, value := range data {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case string:
+			this.messages[key] = &wtkMessage{text: v}
+		case map[string]interface{}:
+			if plural, ok := pluralForms(v); ok {
+				this.messages[key] = &wtkMessage{plural: plural}
+				continue
+			}
+			if err := this.add(key, v); err != nil {
+				return err
+			}
+		default:
+			return errors.New("the value of " + key + " is not a string")
+		}
+	}
+	return nil
+}
+
+func pluralForms(data map[string]interface{}) (map[string]string, bool) {
+	if _, ok := data["other"]; !ok {
+		return nil, false
+	}
+	forms := make(map[string]string, len(data))
+	for key, value := range data {
+		s, ok := value.(string)
+		if !ok || !pluralCategories[key] {
+			return nil, false
+		}
+		forms[key] = s
+	}
+	return forms, true
+}
+
+// checkReload reloads the catalogs in development mode when a file has
+// been added, changed or removed. It checks at most once a second.
+func (this *wtkI18n) checkReload() {
+	if AppEnv != EnvDevelopment {
+		return
+	}
+	this.lock.RLock()
+	dir := this.dir
+	due := dir != "" && time.Since(this.checked) >= time.Second
+	this.lock.RUnlock()
+	if !due {
+		return
+	}
+
+	this.lock.Lock()
+	this.checked = time.Now()
+	modTimes := this.modTimes
+	this.lock.Unlock()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	seen := 0
+	for _, info := range infos {
+		if info.IsDir() || !i18nFile(info.Name()) {
+			continue
+		}
+		if t, ok := modTimes[info.Name()]; !ok || !t.Equal(info.ModTime()) {
+			seen = -1
+			break
+		}
+		seen++
+	}
+	if seen != len(modTimes) {
+		if err := this.Load(dir); err != nil {
+			log.Println("wtk:", err)
+		}
+	}
+}
+
+// match returns the name of the catalog for locale, or for its language.
+func (this *wtkI18n) match(locale string) string {
+	locale = canonicalLocale(locale)
+	if locale == "" {
+		return ""
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if c, ok := this.catalogs[locale]; ok {
+		return c.name
+	}
+	if i := strings.IndexByte(locale, '-'); i > 0 {
+		if c, ok := this.catalogs[locale[:i]]; ok {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// lookup finds the message of key for locale, then its language and then
+// DefaultLocale. Keys the locale does not have are kept for Missing.
+func (this *wtkI18n) lookup(locale string, key string) (*wtkMessage, string) {
+	this.checkReload()
+	locale = canonicalLocale(locale)
+	chain := []string{locale}
+	if i := strings.IndexByte(locale, '-'); i > 0 {
+		chain = append(chain, locale[:i])
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for _, l := range chain {
+		if c, ok := this.catalogs[l]; ok {
+			if msg, ok := c.messages[key]; ok {
+				return msg, l
+			}
+		}
+	}
+	if locale != "" {
+		this.missingLock.Lock()
+		if this.missing[locale] == nil {
+			this.missing[locale] = make(map[string]bool)
+		}
+		this.missing[locale][key] = true
+		this.missingLock.Unlock()
+	}
+	def := canonicalLocale(DefaultLocale)
+	if c, ok := this.catalogs[def]; ok && def != locale {
+		if msg, ok := c.messages[key]; ok {
+			return msg, def
+		}
+	}
+	return nil, locale
+}
+
+// Missing returns the keys each locale lacks, the keys of DefaultLocale
+// that a catalog does not have and those looked up but not found.
+func (this *wtkI18n) Missing() map[string][]string {
+	keys := make(map[string]map[string]bool)
+	add := func(locale string, key string) {
+		if keys[locale] == nil {
+			keys[locale] = make(map[string]bool)
+		}
+		keys[locale][key] = true
+	}
+	this.lock.RLock()
+	def := this.catalogs[canonicalLocale(DefaultLocale)]
+	for _, c := range this.catalogs {
+		if def == nil || c == def {
+			continue
+		}
+		for key := range def.messages {
+			if _, ok := c.messages[key]; !ok {
+				add(c.name, key)
+			}
+		}
+	}
+	this.lock.RUnlock()
+	this.missingLock.Lock()
+	missing := make(map[string][]string, len(this.missing))
+	for locale, m := range this.missing {
+		for key := range m {
+			missing[locale] = append(missing[locale], key)
+		}
+	}
+	this.missingLock.Unlock()
+	for locale, list := range missing {
+		name := this.match(locale)
+		if name == "" {
+			name = locale
+		}
+		for _, key := range list {
+			add(name, key)
+		}
+	}
+
+	report := make(map[string][]string, len(keys))
+	for locale, m := range keys {
+		for key := range m {
+			report[locale] = append(report[locale], key)
+		}
+		sort.Strings(report[locale])
+	}
+	return report
+}
+
+// translate returns the message of key with its {name} placeholders
+// replaced by args. The args are pairs of a name and a value, or a single
+// map. The form of a plural message is chosen by the "count" arg.
+func (this *wtkI18n) translate(locale string, key string, args ...interface{}) string {
+	msg, found := this.lookup(locale, key)
+	if msg == nil {
+		return key
+	}
+	vars := make(map[string]interface{})
+	if len(args) == 1 {
+		if m, ok := args[0].(map[string]interface{}); ok {
+			vars = m
+		}
+	} else {
+		for i := 0; i+1 < len(args); i += 2 {
+			vars[fmt.Sprint(args[i])] = args[i+1]
+		}
+	}
+	text := msg.text
+	if msg.plural != nil {
+		n, _ := toFloat(vars["count"])
+		var ok bool
+		if text, ok = msg.plural[pluralCategory(found, n)]; !ok {
+			text = msg.plural["other"]
+		}
+	}
+	if len(vars) == 0 || !strings.Contains(text, "{") {
+		return text
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(text, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(text[i:], '}')
+		if j < 0 {
+			break
+		}
+		b.WriteString(text[:i])
+		if v, ok := vars[text[i+1:i+j]]; ok {
+			b.WriteString(fmt.Sprint(v))
+		} else {
+			b.WriteString(text[i : i+j+1])
+		}
+		text = text[i+j+1:]
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+// pathLocale splits the locale off a path such as /fr/about.
+func (this *wtkI18n) pathLocale(path string) (string, string) {
+	seg := strings.TrimPrefix(path, "/")
+	rest := "/"
+	if i := strings.IndexByte(seg, '/'); i >= 0 {
+		seg, rest = seg[:i], seg[i:]
+	}
+	this.lock.RLock()
+	c, ok := this.catalogs[canonicalLocale(seg)]
+	this.lock.RUnlock()
+	if !ok || seg == "" {
+		return "", path
+	}
+	return c.name, rest
+}
+
+// acceptLanguages returns the tags of an Accept-Language header by quality.
+func acceptLanguages(header string) []string {
+	type tag struct {
+		name string
+		q    float64
+	}
+	tags := []tag{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if name == "" || name == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, tag{name, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
+	}
+	return names
+}
+
+// Locale returns the locale of the request: the path prefix when
+// EnableLocalePath is set, the LocaleQueryParam query var, the
+// LocaleCookieName cookie or the Accept-Language header, the first one
+// there is a catalog for. The default is DefaultLocale.
+func (this *Context) Locale() string {
+	if this.response.locale != "" {
+		return this.response.locale
+	}
+	i18n := this.hdlr.server.i18n
+	i18n.checkReload()
+	locale := this.response.pathLocale
+	if locale == "" && LocaleQueryParam != "" {
+		locale = i18n.match(this.GetQueryVar(LocaleQueryParam))
+	}
+	// Shared caches must keep the responses by the request headers read.
+	if locale == "" && LocaleCookieName != "" {
+		this.AddHeader("Vary", "Cookie")
+		locale = i18n.match(this.GetCookie(LocaleCookieName))
+	}
+	if locale == "" {
+		this.AddHeader("Vary", "Accept-Language")
+		for _, tag := range acceptLanguages(this.Request.Header.Get("Accept-Language")) {
+			if locale = i18n.match(tag); locale != "" {
+				break
+			}
+		}
+	}
+	if locale == "" {
+		locale = DefaultLocale
+	}
+	this.response.locale = locale
+	return locale
+}
+
+// SetLocale sets the locale of the request and keeps it in the
+// LocaleCookieName cookie for the next requests.
+func (this *Context) SetLocale(locale string) {
+	if name := this.hdlr.server.i18n.match(locale); name != "" {
+		locale = name
+	}
+	this.response.locale = locale
+	if LocaleCookieName != "" {
+		this.SetCookie(LocaleCookieName, locale, 365*24*3600)
+	}
+}
+
+// T returns the message of key in the locale of the request, see
+// Server.LoadLocales. The args are pairs of a name and a value for the
+// {name} placeholders of the message, "count" chooses the plural form.
+// The key is returned when there is no message.
+func (this *Context) T(key string, args ...interface{}) string {
+	return this.hdlr.server.i18n.translate(this.Locale(), key, args...)
+}
+
+// parseTOML reads the tables and string values of a TOML file, which is
+// all a message catalog has.
+func parseTOML(text string) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+	lines := strings.Split(text, "\n")
+	for n := 0; n < len(lines); n++ {
+		line := strings.TrimSpace(lines[n])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lineErr := func(msg string) error {
+			return fmt.Errorf("line %d: %s", n+1, msg)
+		}
+		if line[0] == '[' {
+			end := strings.LastIndexByte(line, ']')
+			if end < 0 || strings.HasPrefix(line, "[[") {
+				return nil, lineErr("invalid table header")
+			}
+			keys, rest, err := parseTOMLKey(line[1:end])
+			if err != nil || strings.TrimSpace(rest) != "" {
+				return nil, lineErr("invalid table name")
+			}
+			if table, err = tomlTable(root, keys); err != nil {
+				return nil, lineErr(err.Error())
+			}
+			if s := strings.TrimSpace(line[end+1:]); s != "" && s[0] != '#' {
+				return nil, lineErr("unexpected text after the table header")
+			}
+			continue
+		}
+		keys, rest, err := parseTOMLKey(line)
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		rest = strings.TrimSpace(rest)
+		if !strings.HasPrefix(rest, "=") {
+			return nil, lineErr("missing =")
+		}
+		rest = strings.TrimSpace(rest[1:])
+		var value string
+		if strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, "'''") {
+			// A multi-line string may go on over the next lines.
+			delim := rest[:3]
+			body := strings.TrimPrefix(rest[3:], "\n")
+			for !strings.Contains(body, delim) {
+				n++
+				if n >= len(lines) {
+					return nil, lineErr("unterminated string")
+				}
+				body += "\n" + lines[n]
+			}
+			i := strings.Index(body, delim)
+			value, rest = body[:i], body[i+3:]
+			if delim == `"""` {
+				if value, err = unquoteTOMLMultiline(value); err != nil {
+					return nil, lineErr(err.Error())
+				}
+			}
+		} else if value, rest, err = parseTOMLString(rest); err != nil {
+			return nil, lineErr(err.Error())
+		}
+		if s := strings.TrimSpace(rest); s != "" && s[0] != '#' {
+			return nil, lineErr("unexpected text after the value")
+		}
+		t, err := tomlTable(table, keys[:len(keys)-1])
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		key := keys[len(keys)-1]
+		if _, ok := t[key]; ok {
+			return nil, lineErr("duplicate key " + key)
+		}
+		t[key] = value
+	}
+	return root, nil
+}
+
+func tomlTable(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	t := root
+	for _, key := range keys {
+		v, ok := t[key]
+		if !ok {
+			v = make(map[string]interface{})
+			t[key] = v
+		}
+		sub, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(key + " is not a table")
+		}
+		t = sub
+	}
+	return t, nil
+}
+
+// parseTOMLKey reads a dotted key of bare and quoted parts.
+func parseTOMLKey(s string) ([]string, string, error) {
+	keys := []string{}
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return nil, "", errors.New("missing key")
+		}
+		var key string
+		if s[0] == '"' || s[0] == '\'' {
+			var err error
+			if key, s, err = parseTOMLString(s); err != nil {
+				return nil, "", err
+			}
+		} else {
+			i := strings.IndexFunc(s, func(r rune) bool {
+				return !(r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+			})
+			if i < 0 {
+				i = len(s)
+			}
+			if i == 0 {
+				return nil, "", errors.New("invalid key")
+			}
+			key, s = s[:i], s[i:]
+		}
+		keys = append(keys, key)
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, ".") {
+			return keys, s, nil
+		}
+		s = s[1:]
+	}
+}
+
+func unquoteTOMLMultiline(s string) (string, error) {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s) {
+				b.WriteString(s[i : i+2])
+				i++
+			}
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	value, err := strconv.Unquote(b.String())
+	if err != nil {
+		return "", errors.New("invalid string")
+	}
+	return value, nil
+}
+
+// parseTOMLString reads a basic or literal string at the start of s.
+func parseTOMLString(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return "", "", errors.New("the value is not a string")
+	}
+	if s[0] == '\'' {
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : i+1], s[i+2:], nil
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", errors.New("invalid string")
+			}
+			return value, s[i+1:], nil
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
@@ -0,0 +1,444 @@
+package wtk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailPart is an inline file or an attachment of a Mail.
+type MailPart struct {
+	Filename    string
+	ContentType string
+	// ContentID is the id of an inline part, its url in the html is cid:ContentID.
+	ContentID string
+	Data      []byte
+}
+
+// Mail is an email with a text and an html body, see Server.RenderMail.
+type Mail struct {
+	From        string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	ReplyTo     string
+	Subject     string
+	Headers     map[string]string
+	Text        string
+	HTML        string
+	Inlines     []*MailPart
+	Attachments []*MailPart
+	inlined     map[string]string
+}
+
+func NewMail() *Mail {
+	return &Mail{Headers: make(map[string]string)}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func mailContentType(filename string, contentType string) string {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
+
+// Attach adds an attachment, the content type is chosen by the extension
+// of filename when it is empty.
+func (this *Mail) Attach(filename string, contentType string, data []byte) {
+	this.Attachments = append(this.Attachments, &MailPart{
+		Filename:    filepath.Base(filename),
+		ContentType: mailContentType(filename, contentType),
+		Data:        data,
+	})
+}
+
+func (this *Mail) AttachFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	this.Attach(filename, "", data)
+	return nil
+}
+
+// Inline adds a file that the html shows, such as an image, and returns
+// its content id. The html refers to it by the url cid:id.
+func (this *Mail) Inline(filename string, contentType string, data []byte) string {
+	part := &MailPart{
+		Filename:    filepath.Base(filename),
+		ContentType: mailContentType(filename, contentType),
+		ContentID:   randomHex(8) + "@wtk",
+		Data:        data,
+	}
+	this.Inlines = append(this.Inlines, part)
+	return part.ContentID
+}
+
+// InlineFile adds a file with Inline, a file is added once.
+func (this *Mail) InlineFile(filename string) (string, error) {
+	if cid, ok := this.inlined[filename]; ok {
+		return cid, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	if this.inlined == nil {
+		this.inlined = make(map[string]string)
+	}
+	this.inlined[filename] = this.Inline(filename, "", data)
+	return this.inlined[filename], nil
+}
+
+func formatAddressList(list []string) (string, error) {
+	addrs, err := mail.ParseAddressList(strings.Join(list, ", "))
+	if err != nil {
+		return "", err
+	}
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ", "), nil
+}
+
+// Recipients returns the addresses of To, Cc and Bcc.
+func (this *Mail) Recipients() ([]string, error) {
+	rcpts := []string{}
+	for _, list := range [][]string{this.To, this.Cc, this.Bcc} {
+		if len(list) == 0 {
+			continue
+		}
+		addrs, err := mail.ParseAddressList(strings.Join(list, ", "))
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return rcpts, nil
+}
+
+type wtkMIMEPart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func textMIMEPart(contentType string, text string) wtkMIMEPart {
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(text))
+	w.Close()
+	return wtkMIMEPart{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: b.Bytes(),
+	}
+}
+
+func fileMIMEPart(part *MailPart, disposition string) wtkMIMEPart {
+	encoded := base64.StdEncoding.EncodeToString(part.Data)
+	var b bytes.Buffer
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	header := textproto.MIMEHeader{
+		"Content-Type":              {part.ContentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType(disposition, map[string]string{"filename": part.Filename})},
+	}
+	if part.ContentID != "" {
+		header.Set("Content-ID", "<"+part.ContentID+">")
+	}
+	return wtkMIMEPart{header: header, body: b.Bytes()}
+}
+
+func multipartMIMEPart(subtype string, parts []wtkMIMEPart) wtkMIMEPart {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for _, part := range parts {
+		pw, _ := w.CreatePart(part.header)
+		pw.Write(part.body)
+	}
+	w.Close()
+	return wtkMIMEPart{
+		header: textproto.MIMEHeader{"Content-Type": {"multipart/" + subtype + "; boundary=" + w.Boundary()}},
+		body:   b.Bytes(),
+	}
+}
+
+func writeMIMEHeader(b *bytes.Buffer, header textproto.MIMEHeader) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range header[key] {
+			b.WriteString(key + ": " + v + "\r\n")
+		}
+	}
+}
+
+// mailReservedHeaders are built from the fields of a Mail and cannot be
+// set with Headers.
+var mailReservedHeaders = map[string]bool{
+	"Mime-Version": true, "Date": true, "Message-Id": true, "From": true, "To": true, "Cc": true,
+	"Bcc": true, "Reply-To": true, "Subject": true, "Content-Type": true,
+	"Content-Transfer-Encoding": true, "Content-Disposition": true, "Content-Id": true,
+}
+
+// validMailHeaderName reports whether name is a header field name, which is
+// made of printable ascii except the colon.
+func validMailHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// Bytes builds the MIME message: the text and html bodies are alternatives,
+// related to the inline files, and mixed with the attachments. Headers
+// cannot set the header fields built from the other fields of the mail.
+func (this *Mail) Bytes() ([]byte, error) {
+	from, err := mail.ParseAddress(this.From)
+	if err != nil {
+		return nil, fmt.Errorf("mail: from: %v", err)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("MIME-Version", "1.0")
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	header.Set("Message-ID", "<"+randomHex(16)+"@"+domain+">")
+	header.Set("From", from.String())
+	for name, list := range map[string][]string{"To": this.To, "Cc": this.Cc, "Reply-To": {this.ReplyTo}} {
+		if len(list) == 0 || list[0] == "" {
+			continue
+		}
+		s, err := formatAddressList(list)
+		if err != nil {
+			return nil, fmt.Errorf("mail: %s: %v", strings.ToLower(name), err)
+		}
+		header.Set(name, s)
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", this.Subject))
+	for name, value := range this.Headers {
+		if !validMailHeaderName(name) {
+			return nil, fmt.Errorf("mail: invalid header name %q", name)
+		}
+		if mailReservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return nil, fmt.Errorf("mail: header %s is set by the mail", name)
+		}
+		header.Set(name, mime.QEncoding.Encode("utf-8", value))
+	}
+
+	bodies := []wtkMIMEPart{}
+	if this.Text != "" || this.HTML == "" {
+		bodies = append(bodies, textMIMEPart("text/plain", this.Text))
+	}
+	if this.HTML != "" {
+		bodies = append(bodies, textMIMEPart("text/html", this.HTML))
+	}
+	root := multipartMIMEPart("alternative", bodies)
+	if len(this.Inlines) > 0 {
+		parts := []wtkMIMEPart{root}
+		for _, part := range this.Inlines {
+			parts = append(parts, fileMIMEPart(part, "inline"))
+		}
+		root = multipartMIMEPart("related", parts)
+	}
+	if len(this.Attachments) > 0 {
+		parts := []wtkMIMEPart{root}
+		for _, part := range this.Attachments {
+			parts = append(parts, fileMIMEPart(part, "attachment"))
+		}
+		root = multipartMIMEPart("mixed", parts)
+	}
+	for key, values := range root.header {
+		header[key] = values
+	}
+
+	var b bytes.Buffer
+	writeMIMEHeader(&b, header)
+	b.WriteString("\r\n")
+	b.Write(root.body)
+	return b.Bytes(), nil
+}
+
+// RenderMail renders the templates name.txt and name.html of the template
+// directory, one of them may be missing. They have the funcs and vars of
+// the server with T in the locale, and mail_inline, which adds a file
+// below AppRoot as an inline part and returns its url. The subject is the
+// "subject" define of either template.
+func (this *Server) RenderMail(name string, locale string, vars map[string]interface{}) (*Mail, error) {
+	m := NewMail()
+	r := this.NewRenderer()
+	r.SetLocale(locale)
+	r.AddFunc("mail_inline", func(path string) (template.URL, error) {
+		cid, err := m.InlineFile(filepath.Join(AppRoot, filepath.FromSlash(path)))
+		return template.URL("cid:" + cid), err
+	})
+
+	found := false
+	for _, part := range []struct {
+		ext  string
+		body *string
+	}{{".txt", &m.Text}, {".html", &m.HTML}} {
+		if !this.templates.Has(name + part.ext) {
+			continue
+		}
+		found = true
+		tpl, err := r.lookup(name + part.ext)
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		if err := r.execute(&b, tpl, "", vars, this.templates.source); err != nil {
+			return nil, err
+		}
+		*part.body = b.String()
+		if bt, ok := tpl.(interface{ hasBlock(name string) bool }); ok && m.Subject == "" && bt.hasBlock("subject") {
+			var s bytes.Buffer
+			if err := r.execute(&s, tpl, "subject", vars, this.templates.source); err != nil {
+				return nil, err
+			}
+			m.Subject = strings.TrimSpace(s.String())
+			// The subject of the html template is escaped for html.
+			if part.ext == ".html" {
+				m.Subject = html.UnescapeString(m.Subject)
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("mail: no template named " + name + ".txt or " + name + ".html")
+	}
+	return m, nil
+}
+
+// MailTransport delivers mails, see Server.SetMailTransport.
+type MailTransport interface {
+	Send(m *Mail) error
+}
+
+// SMTPMailTransport sends mails through an SMTP server such as
+// "smtp.example.com:587", Auth may be nil.
+type SMTPMailTransport struct {
+	Addr string
+	Auth smtp.Auth
+}
+
+func (this *SMTPMailTransport) Send(m *Mail) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, _ := mail.ParseAddress(m.From)
+	rcpts, err := m.Recipients()
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(this.Addr, this.Auth, from.Address, rcpts, msg)
+}
+
+// FileMailTransport writes every mail to a .eml file of Dir, for
+// development and tests.
+type FileMailTransport struct {
+	Dir string
+}
+
+func (this *FileMailTransport) Send(m *Mail) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), randomHex(4))
+	return ioutil.WriteFile(filepath.Join(this.Dir, name), msg, 0600)
+}
+
+// MboxMailTransport appends the mails to the mbox file Filename, for
+// development and tests.
+type MboxMailTransport struct {
+	Filename string
+	lock     sync.Mutex
+}
+
+func (this *MboxMailTransport) Send(m *Mail) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, _ := mail.ParseAddress(m.From)
+	var b bytes.Buffer
+	b.WriteString("From " + from.Address + " " + time.Now().UTC().Format(time.ANSIC) + "\n")
+	for _, line := range strings.Split(strings.Replace(string(msg), "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("\n")
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	f, err := os.OpenFile(this.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SetMailTransport sets the transport of SendMail.
+func (this *Server) SetMailTransport(transport MailTransport) {
+	this.mailTransport = transport
+}
+
+func (this *Server) SendMail(m *Mail) error {
+	if this.mailTransport == nil {
+		return errors.New("mail: no transport, see SetMailTransport")
+	}
+	return this.mailTransport.Send(m)
+}
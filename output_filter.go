@@ -0,0 +1,340 @@
+package wtk
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// OutputFilter rewrites the rendered output of a template before it is
+// written, see Server.AddOutputFilter.
+type OutputFilter func(ctx *Context, content []byte) ([]byte, error)
+
+type wtkOutputFilter struct {
+	name         string
+	filter       OutputFilter
+	contentTypes []string
+}
+
+// wtkOutputFilters is the ordered filter chain of a server.
+type wtkOutputFilters struct {
+	lock    sync.RWMutex
+	filters []*wtkOutputFilter
+}
+
+func (this *wtkOutputFilters) add(name string, filter OutputFilter, contentTypes []string) {
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"text/html"}
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.filters = append(this.filters, &wtkOutputFilter{name: name, filter: filter, contentTypes: contentTypes})
+}
+
+func (this *wtkOutputFilter) matches(contentType string) bool {
+	for _, t := range this.contentTypes {
+		if t == "*" || strings.EqualFold(t, contentType) {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.ToLower(t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply runs the filters that match the content type of the response and
+// are enabled for the route, in the order they were added.
+func (this *wtkOutputFilters) apply(tpl *Template) error {
+	this.lock.RLock()
+	filters := this.filters
+	this.lock.RUnlock()
+	if len(filters) == 0 || tpl.tplResult == nil {
+		return nil
+	}
+	ctx := tpl.hdlr.Context
+	contentType := tpl.contentType()
+	var enabled map[string]bool
+	if route := tpl.hdlr.route; route != nil && route.outputFilters != nil {
+		enabled = make(map[string]bool)
+		for _, name := range route.outputFilters {
+			enabled[name] = true
+		}
+	}
+	content := tpl.tplResult.Bytes()
+	for _, f := range filters {
+		if (enabled != nil && !enabled[f.name]) || !f.matches(contentType) {
+			continue
+		}
+		var err error
+		if content, err = f.filter(ctx, content); err != nil {
+			return err
+		}
+	}
+	tpl.tplResult.SetBytes(content)
+	return nil
+}
+
+// contentType returns the media type of the response, html unless it was
+// set or the template is plain text.
+func (this *Template) contentType() string {
+	if ct := this.hdlr.Context.ResponseWriter.Header().Get("Content-Type"); ct != "" {
+		if t, _, err := mime.ParseMediaType(ct); err == nil {
+			return t
+		}
+		return strings.ToLower(ct)
+	}
+	if _, ok := this.tpl.(*wtkTextTemplate); ok {
+		return "text/plain"
+	}
+	return "text/html"
+}
+
+// AddOutputFilter adds a filter to the end of the chain of the server. It
+// runs after the AfterRender hook for responses of the content types,
+// such as "text/html" or "text/*", text/html by default.
+func (this *Server) AddOutputFilter(name string, filter OutputFilter, contentTypes ...string) {
+	this.filters.add(name, filter, contentTypes)
+}
+
+// OutputFilters sets the output filters that run for this route by their
+// names, no names turn the filters off.
+func (this *Route) OutputFilters(names ...string) {
+	this.outputFilters = append([]string{}, names...)
+}
+
+var htmlBlockTags = map[string]bool{
+	"!doctype": true, "html": true, "head": true, "body": true, "meta": true, "link": true, "title": true,
+	"script": true, "style": true, "div": true, "p": true, "ul": true, "ol": true, "li": true, "dl": true,
+	"dt": true, "dd": true, "table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true,
+	"td": true, "th": true, "section": true, "article": true, "aside": true, "header": true,
+	"footer": true, "nav": true, "main": true, "form": true, "fieldset": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "hr": true, "br": true, "blockquote": true,
+	"figure": true, "figcaption": true, "option": true, "noscript": true,
+}
+
+var htmlRawTags = map[string]bool{"pre": true, "textarea": true, "script": true, "style": true}
+
+func htmlTagName(tag string) string {
+	name := strings.TrimPrefix(tag[1:], "/")
+	if i := strings.IndexAny(name, " \t\r\n/>"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
+
+// htmlTagEnd returns the end of the tag that starts at i, quoted attribute
+// values may hold a >.
+func htmlTagEnd(s []byte, i int) int {
+	var quote byte
+	for j := i + 1; j < len(s); j++ {
+		switch c := s[j]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// MinifyHTML is an output filter that removes comments and collapses the
+// whitespace of html. Whitespace around block tags is removed, the content
+// of pre, textarea, script and style is kept as it is.
+func MinifyHTML(ctx *Context, content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	b.Grow(len(content))
+	trim := true
+	for i := 0; i < len(content); {
+		if bytes.HasPrefix(content[i:], []byte("<!--")) {
+			end := bytes.Index(content[i+4:], []byte("-->"))
+			if end < 0 {
+				end = len(content)
+			} else {
+				end += i + 7
+			}
+			// Conditional comments are kept.
+			if bytes.HasPrefix(content[i:], []byte("<!--[if")) {
+				b.Write(content[i:end])
+			}
+			i = end
+			continue
+		}
+		if content[i] == '<' && i+1 < len(content) && (content[i+1] == '/' || content[i+1] == '!' || isASCIILetter(content[i+1])) {
+			end := htmlTagEnd(content, i)
+			tag := content[i:end]
+			name := htmlTagName(string(tag))
+			if htmlBlockTags[name] {
+				b.Truncate(len(bytes.TrimRight(b.Bytes(), " ")))
+				trim = true
+			} else {
+				trim = false
+			}
+			b.Write(tag)
+			i = end
+			if htmlRawTags[name] && tag[1] != '/' {
+				closing := bytes.Index(bytes.ToLower(content[i:]), []byte("</"+name))
+				if closing < 0 {
+					closing = len(content) - i
+				}
+				b.Write(content[i : i+closing])
+				i += closing
+			}
+			continue
+		}
+		end := bytes.IndexByte(content[i+1:], '<')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += i + 1
+		}
+		for _, field := range splitSpace(content[i:end]) {
+			if field == nil {
+				if !trim && b.Len() > 0 && b.Bytes()[b.Len()-1] != ' ' {
+					b.WriteByte(' ')
+				}
+				continue
+			}
+			b.Write(field)
+			trim = false
+		}
+		i = end
+	}
+	return bytes.TrimSpace(b.Bytes()), nil
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// splitSpace splits text into words, a nil stands for a run of whitespace.
+func splitSpace(text []byte) [][]byte {
+	parts := [][]byte{}
+	start := -1
+	for i, c := range text {
+		space := c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+		if space && start >= 0 {
+			parts = append(parts, text[start:i])
+			start = -1
+		}
+		if space && (len(parts) == 0 || parts[len(parts)-1] != nil) {
+			parts = append(parts, nil)
+		}
+		if !space && start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		parts = append(parts, text[start:])
+	}
+	return parts
+}
+
+var (
+	htmlAttrRegexp       = regexp.MustCompile(`([\w-]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+	inlineLinkRegexp     = regexp.MustCompile(`(?i)<link\b[^>]*>`)
+	inlineScriptRegexp   = regexp.MustCompile(`(?is)<script\b([^>]*)>\s*</script>`)
+	fingerprintURLRegexp = regexp.MustCompile(`(?i)\b(src|href)\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+func htmlAttrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range htmlAttrRegexp.FindAllStringSubmatch(tag, -1) {
+		attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+	}
+	return attrs
+}
+
+// localAsset returns the path below AppRoot of a url of the server, such
+// as /css/app.css.
+func localAsset(ctx *Context, u string) (string, bool) {
+	if !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") {
+		return "", false
+	}
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	prefix := ctx.hdlr.server.router.PrefixPath
+	if prefix != "" {
+		if !strings.HasPrefix(u, prefix+"/") {
+			return "", false
+		}
+		u = u[len(prefix):]
+	}
+	return path.Clean(u), true
+}
+
+func readAsset(ctx *Context, u string) ([]byte, error) {
+	p, ok := localAsset(ctx, u)
+	if !ok {
+		return nil, errors.New("inline: " + u + " is not a file of the server")
+	}
+	return ioutil.ReadFile(filepath.Join(AppRoot, filepath.FromSlash(p)))
+}
+
+// InlineAssets is an output filter that puts the content of local style
+// sheets and scripts marked with a data-inline attribute into the page,
+// such as <link rel="stylesheet" href="/css/app.css" data-inline>.
+func InlineAssets(ctx *Context, content []byte) ([]byte, error) {
+	var err error
+	html := inlineLinkRegexp.ReplaceAllStringFunc(string(content), func(tag string) string {
+		attrs := htmlAttrs(tag[5:])
+		if _, ok := attrs["data-inline"]; !ok || !strings.EqualFold(attrs["rel"], "stylesheet") || err != nil {
+			return tag
+		}
+		css, e := readAsset(ctx, attrs["href"])
+		if e != nil {
+			err = e
+			return tag
+		}
+		return "<style>" + strings.Replace(string(css), "</style", `<\/style`, -1) + "</style>"
+	})
+	html = inlineScriptRegexp.ReplaceAllStringFunc(html, func(tag string) string {
+		attrs := htmlAttrs(inlineScriptRegexp.FindStringSubmatch(tag)[1])
+		if _, ok := attrs["data-inline"]; !ok || attrs["src"] == "" || err != nil {
+			return tag
+		}
+		js, e := readAsset(ctx, attrs["src"])
+		if e != nil {
+			err = e
+			return tag
+		}
+		return "<script>" + strings.Replace(string(js), "</script", `<\/script`, -1) + "</script>"
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(html), nil
+}
+
+// FingerprintAssets is an output filter that adds the content hash of
+// local files to the src and href urls that point to them, as the static
+// template func does.
+func FingerprintAssets(ctx *Context, content []byte) ([]byte, error) {
+	static := ctx.hdlr.server.static
+	html := fingerprintURLRegexp.ReplaceAllStringFunc(string(content), func(attr string) string {
+		m := fingerprintURLRegexp.FindStringSubmatch(attr)
+		quoted := m[2]
+		u := quoted[1 : len(quoted)-1]
+		p, ok := localAsset(ctx, u)
+		if !ok || strings.ContainsAny(u, "?#") {
+			return attr
+		}
+		v := static.version(p)
+		if v == "" {
+			return attr
+		}
+		return m[1] + "=" + quoted[:1] + u + "?v=" + v + quoted[:1]
+	})
+	return []byte(html), nil
+}
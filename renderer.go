@@ -0,0 +1,141 @@
+package wtk
+
+import (
+	"bytes"
+	"io"
+)
+
+// Renderer renders the templates of a server outside a request, such as
+// in background jobs, tools and tests. Templates have the funcs and vars
+// of the server, T uses the locale of the renderer and the funcs bound to
+// a request do nothing. Hooks and output filters do not run. Once set up,
+// a Renderer can be used by several goroutines.
+type Renderer struct {
+	server *Server
+	locale string
+	engine TemplateEngine
+	funcs  map[string]interface{}
+	vars   map[string]interface{}
+}
+
+func (this *Server) NewRenderer() *Renderer {
+	return &Renderer{
+		server: this,
+		funcs:  make(map[string]interface{}),
+		vars:   make(map[string]interface{}),
+	}
+}
+
+// SetLocale sets the locale of T, the default is DefaultLocale.
+func (this *Renderer) SetLocale(locale string) {
+	this.locale = locale
+}
+
+// SetEngine sets the engine like Template.SetEngine.
+func (this *Renderer) SetEngine(engine TemplateEngine) {
+	this.engine = engine
+}
+
+// AddFunc adds a func for the templates of this renderer. Templates of the
+// template directory are compiled with the funcs of the server, so they
+// can only use it to replace one of those.
+func (this *Renderer) AddFunc(name string, tplFunc interface{}) {
+	this.funcs[name] = tplFunc
+}
+
+// SetVar sets a var for every template of this renderer.
+func (this *Renderer) SetVar(name string, value interface{}) {
+	this.vars[name] = value
+}
+
+func (this *Renderer) funcMap() map[string]interface{} {
+	funcs := templateFuncMap(this.server, offlineFuncMap(this.server, this.locale))
+	for name, f := range this.funcs {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+func (this *Renderer) data(vars map[string]interface{}) map[string]interface{} {
+	data := this.server.templateVars()
+	for n, v := range this.vars {
+		data[n] = v
+	}
+	for n, v := range vars {
+		data[n] = v
+	}
+	return data
+}
+
+// lookup returns the template name like Template.SetTemplateFile, bound to
+// the funcs of the renderer.
+func (this *Renderer) lookup(name string) (TemplateExecutor, error) {
+	tpl, err := this.server.templateFile(name, this.engine)
+	if err == nil {
+		tpl, err = tpl.Bind(this.funcMap())
+	}
+	if err != nil {
+		return nil, newTemplateError(err, this.server.templates.source)
+	}
+	return tpl, nil
+}
+
+func (this *Renderer) execute(w io.Writer, tpl TemplateExecutor, block string, vars map[string]interface{}, source func(string) string) error {
+	var b bytes.Buffer
+	var err error
+	if block == "" {
+		err = tpl.Execute(&b, this.data(vars))
+	} else if bt, ok := tpl.(templateBlockExecutor); ok {
+		err = bt.ExecuteBlock(&b, block, this.data(vars))
+	} else {
+		err = errTemplateNoBlocks
+	}
+	if err != nil {
+		return newTemplateError(err, source)
+	}
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// Render renders the template of the template directory with the name
+// name, or else the file name, into w. Nothing is written when it fails.
+func (this *Renderer) Render(w io.Writer, name string, vars map[string]interface{}) error {
+	return this.RenderBlock(w, name, "", vars)
+}
+
+// RenderBlock renders only the block or define block of a template, see
+// Template.RenderBlock.
+func (this *Renderer) RenderBlock(w io.Writer, name string, block string, vars map[string]interface{}) error {
+	tpl, err := this.lookup(name)
+	if err != nil {
+		return err
+	}
+	return this.execute(w, tpl, block, vars, this.server.templates.source)
+}
+
+// RenderString renders the template text, it is compiled by html/template
+// unless an engine is set.
+func (this *Renderer) RenderString(w io.Writer, text string, vars map[string]interface{}) error {
+	source := func(string) string { return text }
+	engine := this.engine
+	if engine == nil {
+		engine = this.server.templateEngine(HTMLTemplateEngine{})
+	}
+	tpl, err := engine.Parse("", text, this.funcMap())
+	if err != nil {
+		return newTemplateError(err, source)
+	}
+	return this.execute(w, tpl, "", vars, source)
+}
+
+func (this *Renderer) RenderBytes(name string, vars map[string]interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := this.Render(&b, name, vars)
+	return b.Bytes(), err
+}
+
+func (this *Renderer) RenderStringBytes(text string, vars map[string]interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := this.RenderString(&b, text, vars)
+	return b.Bytes(), err
+}
@@ -1,6 +1,7 @@
 package wtk
 
 import (
+	"bytes"
 	"compress/gzip"
 	"net/http"
 	"net/url"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type wtkResponseWriter struct {
@@ -18,7 +20,13 @@ type wtkResponseWriter struct {
 	writer     http.ResponseWriter
 	gzipWriter *gzip.Writer
 	httpStatus int
-	Closed     bool
+	status     int
+	recorder   *bytes.Buffer
+	headerFunc []func()
+	err        error
+	locale     string
+	pathLocale string
+	closed     int32
 	Finished   bool
 }
 
@@ -26,11 +34,25 @@ func (this *wtkResponseWriter) Header() http.Header {
 	return this.writer.Header()
 }
 
-func (this *wtkResponseWriter) Write(p []byte) (int, error) {
-	if this.Closed {
-		return 0, nil
+// beforeHeader registers a function that is called once
+// right before the response headers are written.
+func (this *wtkResponseWriter) beforeHeader(f func()) {
+	this.headerFunc = append(this.headerFunc, f)
+}
+
+func (this *wtkResponseWriter) callHeaderFunc() {
+	funcs := this.headerFunc
+	this.headerFunc = nil
+	for _, f := range funcs {
+		f()
 	}
+}
 
+func (this *wtkResponseWriter) writeHeader() {
+	this.callHeaderFunc()
+	if this.isClosed() {
+		return
+	}
 	if this.gzipWriter != nil {
 		this.Header().Set("Content-Encoding", "gzip")
 		this.Header().Del("Content-Length")
@@ -40,7 +62,21 @@ func (this *wtkResponseWriter) Write(p []byte) (int, error) {
 		this.writer.WriteHeader(this.httpStatus)
 		this.httpStatus = 0
 	}
+}
 
+func (this *wtkResponseWriter) Write(p []byte) (int, error) {
+	if this.isClosed() {
+		return 0, nil
+	}
+
+	this.writeHeader()
+	if this.isClosed() {
+		return 0, nil
+	}
+
+	if this.recorder != nil {
+		this.recorder.Write(p)
+	}
 	if this.gzipWriter != nil {
 		return this.gzipWriter.Write(p)
 	}
@@ -48,41 +84,81 @@ func (this *wtkResponseWriter) Write(p []byte) (int, error) {
 }
 
 func (this *wtkResponseWriter) WriteHeader(code int) {
-	if this.Closed {
+	if this.isClosed() {
 		return
 	}
 	this.httpStatus = code
+	this.status = code
 
 	handler := &Handler{}
 	handler.init(this.server, this, this.request)
 	handler.getHandler().callHandlerHook("HttpStatus" + strconv.Itoa(code))
-	if this.Closed {
+	if this.isClosed() {
 		return
 	}
 	if code != http.StatusOK {
 		this.gzipWriter = nil
+		this.callHeaderFunc()
+		if this.isClosed() {
+			return
+		}
 		this.writer.WriteHeader(code)
 		this.httpStatus = 0
 	}
 }
 
+// Flush sends any buffered data to the client.
+// It implements the http.Flusher interface.
+func (this *wtkResponseWriter) Flush() {
+	if this.isClosed() {
+		return
+	}
+	this.writeHeader()
+	if this.gzipWriter != nil {
+		this.gzipWriter.Flush()
+	}
+	if f, ok := this.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close stops the writes of the response, it may be called by another
+// goroutine, such as when the client of an event stream disconnects.
 func (this *wtkResponseWriter) Close() {
-	this.Closed = true
+	atomic.StoreInt32(&this.closed, 1)
+}
+
+func (this *wtkResponseWriter) isClosed() bool {
+	return atomic.LoadInt32(&this.closed) != 0
 }
 
 type Route struct {
-	pattern     string
-	slashCnt    int
-	regexp      *regexp.Regexp
-	params      []string
-	scheme      string
-	handlerType reflect.Type
+	pattern       string
+	slashCnt      int
+	regexp        *regexp.Regexp
+	params        []string
+	scheme        string
+	etag          int
+	csrf          int
+	outputFilters []string
+	cache         *ResponseCacheRule
+	router        *wtkRouter
+	handlerType   reflect.Type
 }
 
 func (this *Route) Scheme(scheme string) {
 	this.scheme = scheme
 }
 
+// ETag overrides the global EnableETag setting for this route.
+func (this *Route) ETag(enable bool) {
+	if enable {
+		this.etag = 1
+	} else {
+		this.etag = -1
+	}
+}
+
 type wtkRouteCache struct {
 	Route *Route
 	Vars  url.Values
@@ -97,6 +173,7 @@ type wtkRouter struct {
 	PrefixPath     string
 	lock           *sync.Mutex
 	routeCache     map[string]*wtkRouteCache
+	namedRoutes    map[string]*Route
 }
 
 func (this *wtkRouter) ClearRouteCache() {
@@ -164,6 +241,7 @@ func (this *wtkRouter) AddRoute(pattern string, handler HandlerInterface) *Route
 		regexp:      nil,
 		params:      []string{},
 		scheme:      "",
+		router:      this,
 		handlerType: reflect.Indirect(reflect.ValueOf(handler)).Type(),
 	}
 	paramCnt := strings.Count(pattern, "{")
@@ -291,7 +369,6 @@ func (this *wtkRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		writer:     rw,
 		gzipWriter: nil,
 		httpStatus: 0,
-		Closed:     false,
 		Finished:   false,
 	}
 	if EnableGzip && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
@@ -314,6 +391,9 @@ func (this *wtkRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		}
 		r.URL.Path = r.URL.Path[len(this.PrefixPath):]
 	}
+	if EnableLocalePath {
+		w.pathLocale, r.URL.Path = this.server.i18n.pathLocale(r.URL.Path)
+	}
 	urlPath := r.URL.Path
 	urlScheme := r.URL.Scheme
 	//static file server
@@ -337,22 +417,22 @@ func (this *wtkRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var handlerType reflect.Type
+	var matched *Route
 
 	if route, ok := this.StaticRoutes[urlPath]; ok {
 		if route.scheme == "" || urlScheme == route.scheme {
-			handlerType = route.handlerType
+			matched = route
 		}
 	}
 
 	pathVars := make(url.Values)
 	if EnableRouteCache {
 		if rc, ok := this.routeCache[urlPath]; ok {
-			handlerType = rc.Route.handlerType
+			matched = rc.Route
 			pathVars = rc.Vars
 		}
 	}
-	if handlerType == nil {
+	if matched == nil {
 		slashCnt := strings.Count(urlPath, "/")
 		for _, route := range this.Routes {
 			if slashCnt != route.slashCnt {
@@ -378,7 +458,7 @@ func (this *wtkRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 					pathVars.Add(route.params[i], match)
 				}
 			}
-			handlerType = route.handlerType
+			matched = route
 			if EnableRouteCache {
 				this.routeCache[urlPath] = &wtkRouteCache{
 					Route: route,
@@ -389,15 +469,35 @@ func (this *wtkRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if handlerType == nil {
+	if matched == nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	handler := reflect.New(handlerType).Interface().(HandlerInterface)
+	var cacheKey string
+	if matched.cache != nil && (r.Method == "GET" || r.Method == "HEAD") {
+		cache := this.server.cache
+		cc := parseCacheControl(r.Header)
+		cacheKey = cache.key(r, matched.cache, hh.Session)
+		if cache.serve(w, r, cacheKey, cc) {
+			return
+		}
+		if r.Method == "GET" && !cc.has("no-store") {
+			w.recorder = new(bytes.Buffer)
+		}
+	}
+
+	handler := reflect.New(matched.handlerType).Interface().(HandlerInterface)
 
 	handler.init(this.server, w, r)
+	handler.getHandler().route = matched
 	handler.context().pathVars = pathVars
+	defer handler.context().close()
+	// The response is stored before close flushes the session, so that a
+	// session still to be saved keeps it out of the cache.
+	if w.recorder != nil {
+		defer this.server.cache.store(w, cacheKey, matched.cache, handler.context())
+	}
 
 	if w.Finished {
 		return
@@ -416,6 +516,15 @@ func (this *wtkRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	case "GET":
 		method = "Get"
 		methodFunc = handler.Get
+		if wsh, ok := handler.(webSocketHandlerInterface); ok {
+			methodFunc = func() {
+				conn, err := wsh.context().UpgradeWebSocket(wsh.webSocket().Subprotocols...)
+				if err != nil {
+					return
+				}
+				wsh.Serve(conn)
+			}
+		}
 	case "POST":
 		method = "Post"
 		methodFunc = handler.Post
@@ -0,0 +1,192 @@
+package wtk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secure cookies are sealed with AES-256-GCM. The cookie value is
+//
+//	"2|" + base64url(key id | nonce | ciphertext)
+//
+// The plaintext holds the expiry time and the value, the cookie name and the
+// optional User-Agent and IP bindings are authenticated as additional data.
+// The key id selects one of CookieSecret and CookieOldSecrets, so secrets can
+// be rotated without invalidating the cookies issued with the previous one.
+const secureCookieVersion = "2|"
+
+const defaultCookieSecret = "foobar"
+
+type wtkCookieKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newCookieKey(secret string) *wtkCookieKey {
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	id := sha256.Sum256(sum[:])
+	return &wtkCookieKey{id: id[:4], aead: aead}
+}
+
+// cookieKeyCache holds the keys of the secrets they were built from, they
+// are built again when CookieSecret or CookieOldSecrets change.
+var cookieKeyCache struct {
+	lock    sync.RWMutex
+	secrets []string
+	keys    []*wtkCookieKey
+}
+
+func cookieKeys() []*wtkCookieKey {
+	secrets := []string{CookieSecret}
+	for _, secret := range CookieOldSecrets {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	cookieKeyCache.lock.RLock()
+	keys := cookieKeyCache.keys
+	same := len(cookieKeyCache.secrets) == len(secrets)
+	for i := 0; same && i < len(secrets); i++ {
+		same = cookieKeyCache.secrets[i] == secrets[i]
+	}
+	cookieKeyCache.lock.RUnlock()
+	if same {
+		return keys
+	}
+	keys = make([]*wtkCookieKey, len(secrets))
+	for i, secret := range secrets {
+		keys[i] = newCookieKey(secret)
+	}
+	cookieKeyCache.lock.Lock()
+	cookieKeyCache.secrets, cookieKeyCache.keys = secrets, keys
+	cookieKeyCache.lock.Unlock()
+	return keys
+}
+
+// checkCookieSecret refuses the default secret unless AppEnv is development.
+func checkCookieSecret() error {
+	if AppEnv != EnvDevelopment && (CookieSecret == "" || CookieSecret == defaultCookieSecret) {
+		return errors.New("CookieSecret must be changed from the default unless AppEnv is development")
+	}
+	return nil
+}
+
+func (this *Context) cookieBinding() string {
+	binding := ""
+	if CookieBindUserAgent {
+		binding += this.Request.UserAgent()
+	}
+	if CookieBindIP {
+		binding += "|" + this.remoteIP()
+	}
+	return binding
+}
+
+func (this *Context) encodeSecureCookie(name string, value string, maxage int) string {
+	var expires int64
+	if maxage > 0 {
+		expires = time.Now().Add(time.Duration(maxage) * time.Second).Unix()
+	}
+	key := cookieKeys()[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	plaintext := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(plaintext, uint64(expires))
+	plaintext = append(plaintext, value...)
+	ad := []byte(name + "|" + this.cookieBinding())
+
+	out := make([]byte, 0, len(key.id)+len(nonce)+len(plaintext)+key.aead.Overhead())
+	out = append(out, key.id...)
+	out = append(out, nonce...)
+	out = key.aead.Seal(out, nonce, plaintext, ad)
+	return secureCookieVersion + base64.RawURLEncoding.EncodeToString(out)
+}
+
+func (this *Context) decodeSecureCookie(name string, str string) (string, bool) {
+	if !strings.HasPrefix(str, secureCookieVersion) {
+		if CookieAllowLegacy {
+			return this.decodeLegacySecureCookie(name, str), true
+		}
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(str[len(secureCookieVersion):])
+	if err != nil || len(b) < 4 {
+		return "", false
+	}
+	ad := []byte(name + "|" + this.cookieBinding())
+	for _, key := range cookieKeys() {
+		if !bytes.Equal(b[:4], key.id) {
+			continue
+		}
+		rest := b[4:]
+		if len(rest) < key.aead.NonceSize() {
+			return "", false
+		}
+		nonce := rest[:key.aead.NonceSize()]
+		plaintext, err := key.aead.Open(nil, nonce, rest[len(nonce):], ad)
+		if err != nil || len(plaintext) < 8 {
+			return "", false
+		}
+		expires := int64(binary.BigEndian.Uint64(plaintext))
+		if expires > 0 && time.Now().Unix() > expires {
+			return "", false
+		}
+		return string(plaintext[8:]), false
+	}
+	return "", false
+}
+
+// decodeLegacySecureCookie reads cookies written before the AEAD format,
+// which were encrypted with AES-CTR and signed with HMAC-SHA1.
+func (this *Context) decodeLegacySecureCookie(name string, str string) string {
+	strs := strings.SplitN(str, "|", 2)
+	if len(strs) != 2 {
+		return ""
+	}
+	sig := strs[0]
+	b, err := base64.URLEncoding.DecodeString(strs[1])
+	if err != nil {
+		return ""
+	}
+	secrets := append([]string{CookieSecret}, CookieOldSecrets...)
+	for _, secret := range secrets {
+		decrypted := string(util.AesDecrypt([]byte(secret), append([]byte{}, b...)))
+		parts := strings.SplitN(decrypted, "|", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ts := parts[0]
+		value := parts[1]
+		text := name + value + ts + this.Request.UserAgent()
+		if !hmac.Equal([]byte(util.getCookieSig(secret, text)), []byte(sig)) {
+			continue
+		}
+		expires, err := strconv.ParseInt(ts, 0, 64)
+		if err != nil || expires > 0 && time.Now().Unix() > expires {
+			return ""
+		}
+		return value
+	}
+	return ""
+}
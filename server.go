@@ -1,6 +1,7 @@
 package wtk
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -14,12 +15,21 @@ import (
 )
 
 type Server struct {
-	Id       int
-	RunMode  string
-	listener net.Listener
-	router   *wtkRouter
-	hook     *wtkHook
-	session  *wtkSessionManager
+	Id        int
+	RunMode   string
+	listener  net.Listener
+	router    *wtkRouter
+	hook      *wtkHook
+	session   *wtkSessionManager
+	cache     *wtkResponseCache
+	templates *wtkTemplateRegistry
+	tplFuncs  map[string]interface{}
+	tplConfig *wtkTemplateConfig
+	static    *wtkStaticVersions
+	i18n      *wtkI18n
+	filters   *wtkOutputFilters
+
+	mailTransport MailTransport
 }
 
 func (this *Server) init(id int) *Server {
@@ -32,10 +42,21 @@ func (this *Server) init(id int) *Server {
 		StaticFileType: make(map[string]int),
 		lock:           new(sync.Mutex),
 		routeCache:     make(map[string]*wtkRouteCache),
+		namedRoutes:    make(map[string]*Route),
 	}
 	this.hook = &wtkHook{server: this}
+	for _, event := range []string{HookBeforeMethodPost, HookBeforeMethodPut, HookBeforeMethodDelete, HookBeforeMethodPatch} {
+		this.hook.AddHandlerHook(event, csrfHook)
+	}
 	this.session = new(wtkSessionManager)
 	this.session.RegisterStorage(new(wtkDefaultSessionStorage))
+	this.cache = &wtkResponseCache{storage: NewMemoryResponseCache(ResponseCacheSize)}
+	this.templates = newTemplateRegistry(this)
+	this.tplFuncs = builtinTemplateFuncs(this)
+	this.tplConfig = newTemplateConfig()
+	this.i18n = newI18n()
+	this.filters = new(wtkOutputFilters)
+	this.static = &wtkStaticVersions{files: make(map[string]*wtkStaticFile)}
 	return this
 }
 
@@ -88,7 +109,78 @@ func (this *Server) RegisterSessionStorage(storage SessionStorageInterface) {
 	this.session.RegisterStorage(storage)
 }
 
+func (this *Server) RegisterSessionStore(store SessionStore) {
+	this.session.RegisterStore(store)
+}
+
+// UserSessions lists the sessions bound to a user with Session.SetUser.
+func (this *Server) UserSessions(userId string) ([]SessionInfo, error) {
+	return this.session.UserSessions(context.Background(), userId)
+}
+
+func (this *Server) RevokeSession(sid string) error {
+	return this.session.Destroy(context.Background(), sid)
+}
+
+// RevokeUserSessions logs a user out everywhere.
+func (this *Server) RevokeUserSessions(userId string) error {
+	return this.session.RevokeUserSessions(context.Background(), userId, "")
+}
+
+func (this *Server) RegisterResponseCacheStorage(storage ResponseCacheStorageInterface) {
+	this.cache.RegisterStorage(storage)
+}
+
+// InvalidateResponseCache drops every cached response carrying one of the tags.
+func (this *Server) InvalidateResponseCache(tags ...string) {
+	this.cache.Invalidate(tags...)
+}
+
+func (this *Server) ClearResponseCache() {
+	this.cache.storage.Clear()
+}
+
+// URLFor builds the path of a route named with Route.Name.
+func (this *Server) URLFor(name string, args ...interface{}) (string, error) {
+	return this.router.URLFor(name, args...)
+}
+
+// LoadTemplates compiles the templates below dir, a relative dir is
+// relative to AppRoot. An empty dir is the one of SetTemplateDir or
+// TemplateDir. See Template.SetTemplateName.
+func (this *Server) LoadTemplates(dir string) error {
+	if dir == "" {
+		dir = this.templateDir()
+	}
+	return this.templates.Load(dir)
+}
+
+// LoadLocales reads the message catalogs of dir, a relative dir is
+// relative to AppRoot. See Context.T.
+func (this *Server) LoadLocales(dir string) error {
+	return this.i18n.Load(dir)
+}
+
+// MissingTranslations returns the message keys each locale lacks, see
+// Context.T.
+func (this *Server) MissingTranslations() map[string][]string {
+	return this.i18n.Missing()
+}
+
 func (this *Server) Run(mode string, addr string, port int) error {
+	if err := checkCookieSecret(); err != nil {
+		return err
+	}
+	if I18nDir != "" && this.i18n.dir == "" {
+		if err := this.LoadLocales(I18nDir); err != nil {
+			return err
+		}
+	}
+	if dir := this.templateDir(); dir != "" && this.templates.dir == "" {
+		if err := this.LoadTemplates(dir); err != nil {
+			return err
+		}
+	}
 	var tlsConfig *tls.Config
 	var err error
 	if mode == "https" {
@@ -144,6 +236,14 @@ func (this *Server) Close() {
 	if this.listener != nil {
 		this.listener.Close()
 	}
+	// Servers made by Clone share the session manager,
+	// so it is only closed with the last of them.
+	for _, s := range servers {
+		if s.session == this.session {
+			return
+		}
+	}
+	this.session.Close()
 }
 
 func (this *Server) Clone() *Server {
@@ -151,5 +251,13 @@ func (this *Server) Clone() *Server {
 	a.router = this.router
 	a.hook = this.hook
 	a.session = this.session
+	a.cache = this.cache
+	a.templates = this.templates
+	a.tplFuncs = this.tplFuncs
+	a.tplConfig = this.tplConfig
+	a.i18n = this.i18n
+	a.filters = this.filters
+	a.mailTransport = this.mailTransport
+	a.static = this.static
 	return a
 }
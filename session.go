@@ -1,8 +1,19 @@
 package wtk
 
 import (
-	"fmt"
-	"time"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrSessionKeyNotFound = errors.New("session key not found")
 )
 
 type SessionStorageInterface interface {
@@ -13,67 +24,369 @@ type SessionStorageInterface interface {
 	Delete(string)
 }
 
+// SessionStorageExistsInterface can be implemented by a storage to report
+// whether it has issued a session ID. Unknown IDs sent by a client are then
+// replaced with a new session instead of being adopted.
+type SessionStorageExistsInterface interface {
+	Exists(string) bool
+}
+
+// SessionContextStorageInterface can be implemented by a storage that keeps
+// the session on the client and so needs the request and the response.
+// Load returns an empty session ID when there is no valid session.
+// Save must be called before the response headers are written, its error
+// is handled by SessionFailurePolicy.
+type SessionContextStorageInterface interface {
+	Load(ctx *Context) (string, map[string]string)
+	Save(ctx *Context, sid string, data map[string]string) error
+	Destroy(ctx *Context)
+}
+
+// SessionStore is the error and context aware storage interface.
+// Load returns ErrSessionNotFound for an unknown or expired session and
+// extends the expiry of a found one, Touch only extends the expiry.
+// A store may also have Init(ttl int64) and CreateSessionID() string methods,
+// they are called like the ones of SessionStorageInterface.
+type SessionStore interface {
+	Load(ctx context.Context, sid string) (map[string]string, error)
+	Save(ctx context.Context, sid string, data map[string]string) error
+	Destroy(ctx context.Context, sid string) error
+	Touch(ctx context.Context, sid string) error
+	Close() error
+}
+
+const (
+	SessionFailOpen   = "open"
+	SessionFailClosed = "closed"
+)
+
+// wtkSessionStorageAdapter lets a SessionStorageInterface be used as a SessionStore.
+type wtkSessionStorageAdapter struct {
+	storage SessionStorageInterface
+}
+
+func (this *wtkSessionStorageAdapter) Init(ttl int64) {
+	this.storage.Init(ttl)
+}
+
+func (this *wtkSessionStorageAdapter) CreateSessionID() string {
+	return this.storage.CreateSessionID()
+}
+
+func (this *wtkSessionStorageAdapter) Load(ctx context.Context, sid string) (map[string]string, error) {
+	if s, ok := this.storage.(SessionStorageExistsInterface); ok && !s.Exists(sid) {
+		return nil, ErrSessionNotFound
+	}
+	return this.storage.Get(sid), nil
+}
+
+func (this *wtkSessionStorageAdapter) Save(ctx context.Context, sid string, data map[string]string) error {
+	this.storage.Set(sid, data)
+	return nil
+}
+
+func (this *wtkSessionStorageAdapter) Destroy(ctx context.Context, sid string) error {
+	this.storage.Delete(sid)
+	return nil
+}
+
+func (this *wtkSessionStorageAdapter) Touch(ctx context.Context, sid string) error {
+	this.storage.Get(sid)
+	return nil
+}
+
+func (this *wtkSessionStorageAdapter) Close() error {
+	switch s := this.storage.(type) {
+	case interface{ Close() error }:
+		return s.Close()
+	case interface{ Close() }:
+		s.Close()
+	}
+	return nil
+}
+
 type wtkSessionManager struct {
-	sessionStorage SessionStorageInterface
-	inited         bool
+	store   SessionStore
+	storage interface{}
+	inited  bool
+	lock    sync.Mutex
 }
 
+// RegisterStorage accepts a SessionStorageInterface, which is used through
+// an adapter unless it also implements SessionStore.
 func (this *wtkSessionManager) RegisterStorage(storage SessionStorageInterface) {
 	if storage == nil {
 		return
 	}
-	this.sessionStorage = storage
+	if store, ok := storage.(SessionStore); ok {
+		this.RegisterStore(store)
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.store = &wtkSessionStorageAdapter{storage: storage}
+	this.storage = storage
+	this.inited = false
+}
+
+func (this *wtkSessionManager) RegisterStore(store SessionStore) {
+	if store == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.store = store
+	this.storage = store
 	this.inited = false
 }
 
 func (this *wtkSessionManager) checkInit() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	if !this.inited {
-		this.sessionStorage.Init(SessionTTL)
+		if s, ok := this.store.(interface{ Init(int64) }); ok {
+			s.Init(SessionTTL)
+		}
 		this.inited = true
 	}
 }
 
+func (this *wtkSessionManager) Close() error {
+	return this.store.Close()
+}
+
 func (this *wtkSessionManager) CreateSessionID() string {
 	this.checkInit()
-	return this.sessionStorage.CreateSessionID()
+	if s, ok := this.store.(interface{ CreateSessionID() string }); ok {
+		return s.CreateSessionID()
+	}
+	return util.randomId(32)
+}
+
+func (this *wtkSessionManager) contextStorage() SessionContextStorageInterface {
+	this.checkInit()
+	if s, ok := this.storage.(SessionContextStorageInterface); ok {
+		return s
+	}
+	return nil
+}
+
+func (this *wtkSessionManager) Load(ctx context.Context, sid string) (map[string]string, error) {
+	this.checkInit()
+	data, err := this.store.Load(ctx, sid)
+	if err == nil && data == nil {
+		data = make(map[string]string)
+	}
+	return data, err
 }
 
-func (this *wtkSessionManager) Set(sid string, data map[string]string) {
+func (this *wtkSessionManager) Save(ctx context.Context, sid string, data map[string]string) error {
 	this.checkInit()
-	this.sessionStorage.Set(sid, data)
+	return this.store.Save(ctx, sid, data)
 }
 
-func (this *wtkSessionManager) Get(sid string) map[string]string {
+func (this *wtkSessionManager) Destroy(ctx context.Context, sid string) error {
 	this.checkInit()
-	return this.sessionStorage.Get(sid)
+	return this.store.Destroy(ctx, sid)
 }
 
-func (this *wtkSessionManager) Delete(sid string) {
+func (this *wtkSessionManager) Touch(ctx context.Context, sid string) error {
 	this.checkInit()
-	this.sessionStorage.Delete(sid)
+	return this.store.Touch(ctx, sid)
 }
 
+const sessionFlashKey = "_flash"
+
 type Session struct {
 	hdlr           *Handler
 	sessionManager *wtkSessionManager
 	sessionId      string
 	data           map[string]string
 	inited         bool
+	dirty          bool
+	destroyed      bool
+	loadFailed     bool
+	err            error
+}
+
+func (this *Session) context() context.Context {
+	return this.hdlr.Context.Request.Context()
+}
+
+// fail records a storage error and applies SessionFailurePolicy,
+// a closed policy answers the request with 503 Service Unavailable.
+func (this *Session) fail(err error) {
+	this.err = err
+	log.Println("wtk: session storage error:", err)
+	if SessionFailurePolicy == SessionFailClosed {
+		this.hdlr.Context.Abort(http.StatusServiceUnavailable, "Service Unavailable")
+	}
 }
 
 func (this *Session) init() {
 	if this.inited {
 		return
 	}
-	this.sessionId = this.hdlr.Context.GetSecureCookie(SessionName)
+	this.inited = true
+	this.hdlr.Context.response.beforeHeader(this.flush)
+
+	cs := this.sessionManager.contextStorage()
+	if !this.destroyed {
+		if cs != nil {
+			this.sessionId, this.data = cs.Load(this.hdlr.Context)
+		} else if sid, legacy := this.hdlr.Context.getSecureCookie(SessionName); sid != "" {
+			data, err := this.sessionManager.Load(this.context(), sid)
+			switch err {
+			case nil:
+				this.sessionId = sid
+				this.data = data
+				if legacy {
+					this.setCookie()
+				}
+				this.trackClient()
+			case ErrSessionNotFound:
+			default:
+				// The session is kept empty for this request and not saved,
+				// so that the stored data is not overwritten once the
+				// storage is back.
+				this.sessionId = sid
+				this.data = make(map[string]string)
+				this.loadFailed = true
+				this.fail(err)
+				return
+			}
+		}
+	}
 	if this.sessionId == "" {
 		this.sessionId = this.sessionManager.CreateSessionID()
-		this.hdlr.Context.SetSecureCookie(SessionName, this.sessionId, 0)
+		this.data = make(map[string]string)
+		if cs != nil {
+			this.dirty = true
+		} else {
+			if err := this.sessionManager.Save(this.context(), this.sessionId, this.data); err != nil {
+				this.fail(err)
+				return
+			}
+			this.setCookie()
+		}
+	}
+}
+
+func (this *Session) save() {
+	this.dirty = false
+	if cs := this.sessionManager.contextStorage(); cs != nil {
+		if err := cs.Save(this.hdlr.Context, this.sessionId, this.data); err != nil {
+			this.fail(err)
+		}
+		return
 	}
-	if this.data == nil {
-		this.data = this.sessionManager.Get(this.sessionId)
+	if this.loadFailed {
+		return
+	}
+	if err := this.sessionManager.Save(this.context(), this.sessionId, this.data); err != nil {
+		this.fail(err)
 	}
-	this.inited = true
+}
+
+// flush saves the session if it was changed. It is called right before the
+// response headers are written and again when the request is done.
+func (this *Session) flush() {
+	if this.inited && this.dirty {
+		this.save()
+	}
+}
+
+func (this *Session) Id() string {
+	this.init()
+	return this.sessionId
+}
+
+// Err returns the last error of the session storage.
+func (this *Session) Err() error {
+	return this.err
+}
+
+// Touch extends the expiry of the session without changing it.
+func (this *Session) Touch() error {
+	this.init()
+	if this.sessionManager.contextStorage() != nil {
+		this.dirty = true
+		return nil
+	}
+	err := this.sessionManager.Touch(this.context(), this.sessionId)
+	if err != nil {
+		this.err = err
+	}
+	return err
+}
+
+// Regenerate moves the session data to a new session ID and drops the old one.
+// It should be called when the privilege level changes, such as on login,
+// to prevent session fixation. It does nothing when the session could not be
+// loaded, so that the stored session is not lost, see Err.
+func (this *Session) Regenerate() {
+	this.init()
+	if this.loadFailed {
+		return
+	}
+	oldId := this.sessionId
+	this.sessionId = this.sessionManager.CreateSessionID()
+	this.save()
+	if this.sessionManager.contextStorage() != nil {
+		return
+	}
+	if err := this.sessionManager.Destroy(this.context(), oldId); err != nil {
+		this.fail(err)
+	}
+	this.setCookie()
+}
+
+// Destroy removes the session from the storage and expires the cookie.
+// Using the session afterwards starts a new one.
+func (this *Session) Destroy() {
+	this.init()
+	if cs := this.sessionManager.contextStorage(); cs != nil {
+		cs.Destroy(this.hdlr.Context)
+	} else {
+		if err := this.sessionManager.Destroy(this.context(), this.sessionId); err != nil {
+			this.fail(err)
+		}
+		options := NewCookieOptions()
+		options.HttpOnly = true
+		this.hdlr.Context.DeleteCookie(SessionName, options)
+	}
+	this.sessionId = ""
+	this.data = nil
+	this.dirty = false
+	this.loadFailed = false
+	this.inited = false
+	this.destroyed = true
+}
+
+func (this *Session) setCookie() {
+	options := NewCookieOptions()
+	options.HttpOnly = true
+	this.hdlr.Context.SetSecureCookieWithOptions(SessionName, this.sessionId, options)
+}
+
+// peek reads a value of the current session without creating one.
+func (this *Session) peek(key string) string {
+	if this.inited {
+		return this.data[key]
+	}
+	if cs := this.sessionManager.contextStorage(); cs != nil {
+		_, data := cs.Load(this.hdlr.Context)
+		return data[key]
+	}
+	sid := this.hdlr.Context.GetSecureCookie(SessionName)
+	if sid == "" {
+		return ""
+	}
+	data, err := this.sessionManager.Load(this.context(), sid)
+	if err != nil {
+		return ""
+	}
+	return data[key]
 }
 
 func (this *Session) Get(key string) string {
@@ -86,72 +399,104 @@ func (this *Session) Get(key string) string {
 
 func (this *Session) Set(key string, data string) {
 	this.init()
+	if sessionUserKeys[key] {
+		return
+	}
 	this.data[key] = data
-	this.sessionManager.Set(this.sessionId, this.data)
+	this.dirty = true
 }
 
 func (this *Session) Delete(key string) {
 	this.init()
-	delete(this.data, key)
-	this.sessionManager.Set(this.sessionId, this.data)
-}
-
-type wtkDefaultSessionStorage struct {
-	ttl   int64
-	datas map[string]wtkDefaultSessionStorageData
-	incr  *wtkAutoIncr
+	if _, exist := this.data[key]; exist && !sessionUserKeys[key] {
+		delete(this.data, key)
+		this.dirty = true
+	}
 }
 
-type wtkDefaultSessionStorageData struct {
-	expires int64
-	data    map[string]string
+func (this *Session) Has(key string) bool {
+	this.init()
+	_, exist := this.data[key]
+	return exist
 }
 
-func (this *wtkDefaultSessionStorage) Init(ttl int64) {
-	if this.datas != nil {
-		return
+func (this *Session) Keys() []string {
+	this.init()
+	keys := make([]string, 0, len(this.data))
+	for k := range this.data {
+		if !sessionUserKeys[k] {
+			keys = append(keys, k)
+		}
 	}
-	this.ttl = ttl
-	this.datas = make(map[string]wtkDefaultSessionStorageData)
-	go this.gc()
-	this.incr = newAutoIncr(1, 1)
+	sort.Strings(keys)
+	return keys
 }
 
-func (this *wtkDefaultSessionStorage) gc() {
-	for {
-		if len(this.datas) > 0 {
-			now := time.Now().Unix()
-			for sid, data := range this.datas {
-				if data.expires <= now {
-					delete(this.datas, sid)
-				}
-			}
+// Clear removes all values but keeps the session and its user.
+func (this *Session) Clear() {
+	this.init()
+	for k := range this.data {
+		if !sessionUserKeys[k] {
+			delete(this.data, k)
+			this.dirty = true
 		}
-		time.Sleep(time.Second)
 	}
 }
 
-func (this *wtkDefaultSessionStorage) CreateSessionID() string {
-	t := time.Now()
-	return "SESS" + fmt.Sprintf("%d%d", t.Unix(), this.incr.Fetch())
+// SetValue stores any JSON serializable value.
+func (this *Session) SetValue(key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	this.Set(key, string(b))
+	return nil
 }
 
-func (this *wtkDefaultSessionStorage) Set(sid string, data map[string]string) {
-	d := wtkDefaultSessionStorageData{
-		expires: time.Now().Unix() + this.ttl,
-		data:    data,
+// GetValue decodes a value stored by SetValue into v.
+func (this *Session) GetValue(key string, v interface{}) error {
+	this.init()
+	data, exist := this.data[key]
+	if !exist {
+		return ErrSessionKeyNotFound
 	}
-	this.datas[sid] = d
+	return json.Unmarshal([]byte(data), v)
 }
 
-func (this *wtkDefaultSessionStorage) Get(sid string) map[string]string {
-	if data, exist := this.datas[sid]; exist {
-		data.expires = time.Now().Unix() + this.ttl
-		return data.data
-	}
-	return make(map[string]string)
+func (this *Session) GetInt(key string) int {
+	i, _ := strconv.Atoi(this.Get(key))
+	return i
+}
+
+func (this *Session) GetInt64(key string) int64 {
+	i, _ := strconv.ParseInt(this.Get(key), 10, 64)
+	return i
+}
+
+func (this *Session) GetFloat(key string) float64 {
+	f, _ := strconv.ParseFloat(this.Get(key), 64)
+	return f
+}
+
+func (this *Session) GetBool(key string) bool {
+	b, _ := strconv.ParseBool(this.Get(key))
+	return b
+}
+
+// AddFlash stores a message that is read once by Flashes,
+// usually on the next request.
+func (this *Session) AddFlash(message string) {
+	flashes := []string{}
+	this.GetValue(sessionFlashKey, &flashes)
+	this.SetValue(sessionFlashKey, append(flashes, message))
 }
 
-func (this *wtkDefaultSessionStorage) Delete(sid string) {
-	delete(this.datas, sid)
+// Flashes returns the flash messages and removes them from the session.
+// Templates can read them with the flashes function.
+func (this *Session) Flashes() []string {
+	flashes := []string{}
+	if this.GetValue(sessionFlashKey, &flashes) == nil {
+		this.Delete(sessionFlashKey)
+	}
+	return flashes
 }
@@ -0,0 +1,129 @@
+package wtk
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// ErrSessionTooLarge is the error of a session that does not fit into the
+// cookies of CookieSessionStorage, the changes are not saved.
+var ErrSessionTooLarge = errors.New("wtk: session too large for its cookies")
+
+// Browsers accept about 4096 bytes per cookie including its attributes,
+// so the encoded session is split into chunks of this size.
+const cookieSessionChunkSize = 3800
+
+// CookieSessionStorage keeps the whole session in the client's cookies,
+// sealed with the secure cookie format, so no server side state is needed.
+// A session larger than one cookie is split over SessionName, SessionName_1,
+// SessionName_2 and so on, up to maxChunks cookies. The session expires
+// SessionTTL seconds after it was last changed.
+// Changes made after the response headers are sent can not be saved.
+type CookieSessionStorage struct {
+	ttl       int64
+	maxChunks int
+}
+
+type wtkCookieSessionData struct {
+	Id   string            `json:"i"`
+	Data map[string]string `json:"d"`
+}
+
+// NewCookieSessionStorage creates a storage using at most maxChunks cookies,
+// 0 means 4 cookies.
+func NewCookieSessionStorage(maxChunks int) *CookieSessionStorage {
+	if maxChunks <= 0 {
+		maxChunks = 4
+	}
+	return &CookieSessionStorage{maxChunks: maxChunks}
+}
+
+func (this *CookieSessionStorage) Init(ttl int64) {
+	this.ttl = ttl
+}
+
+func (this *CookieSessionStorage) CreateSessionID() string {
+	return util.randomId(32)
+}
+
+// The ID based methods are not used since the session lives in the request.
+func (this *CookieSessionStorage) Set(sid string, data map[string]string) {}
+
+func (this *CookieSessionStorage) Get(sid string) map[string]string {
+	return make(map[string]string)
+}
+
+func (this *CookieSessionStorage) Delete(sid string) {}
+
+func chunkCookieName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "_" + strconv.Itoa(i)
+}
+
+func (this *CookieSessionStorage) Load(ctx *Context) (string, map[string]string) {
+	str := ""
+	for i := 0; i < this.maxChunks; i++ {
+		chunk := ctx.GetCookie(chunkCookieName(SessionName, i))
+		if chunk == "" {
+			break
+		}
+		str += chunk
+	}
+	if str == "" {
+		return "", make(map[string]string)
+	}
+	value, _ := ctx.decodeSecureCookie(SessionName, str)
+	d := &wtkCookieSessionData{}
+	if value == "" || json.Unmarshal([]byte(value), d) != nil || d.Id == "" {
+		return "", make(map[string]string)
+	}
+	if d.Data == nil {
+		d.Data = make(map[string]string)
+	}
+	return d.Id, d.Data
+}
+
+func (this *CookieSessionStorage) Save(ctx *Context, sid string, data map[string]string) error {
+	b, err := json.Marshal(&wtkCookieSessionData{Id: sid, Data: data})
+	if err != nil {
+		return err
+	}
+	str := ctx.encodeSecureCookie(SessionName, string(b), int(this.ttl))
+	chunks := []string{}
+	for len(str) > cookieSessionChunkSize {
+		chunks = append(chunks, str[:cookieSessionChunkSize])
+		str = str[cookieSessionChunkSize:]
+	}
+	chunks = append(chunks, str)
+	if len(chunks) > this.maxChunks {
+		// Keeping the old cookies is safer than sending a truncated session.
+		return ErrSessionTooLarge
+	}
+
+	options := NewCookieOptions()
+	options.HttpOnly = true
+	for i, chunk := range chunks {
+		ctx.SetCookieWithOptions(chunkCookieName(SessionName, i), chunk, options)
+	}
+	for i := len(chunks); i < this.maxChunks; i++ {
+		name := chunkCookieName(SessionName, i)
+		if ctx.GetCookie(name) != "" {
+			ctx.DeleteCookie(name, options)
+		}
+	}
+	return nil
+}
+
+func (this *CookieSessionStorage) Destroy(ctx *Context) {
+	options := NewCookieOptions()
+	options.HttpOnly = true
+	for i := 0; i < this.maxChunks; i++ {
+		name := chunkCookieName(SessionName, i)
+		if i == 0 || ctx.GetCookie(name) != "" {
+			ctx.DeleteCookie(name, options)
+		}
+	}
+}
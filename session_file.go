@@ -0,0 +1,361 @@
+package wtk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSessionStorage keeps one file per session so that sessions survive
+// a restart. Files are spread over sub directories named after the first
+// two characters of the session ID. Every write goes to a temporary file
+// that is renamed into place, and a lock file in each sub directory
+// serializes access between processes sharing the directory.
+// The modification time of a file is its last access, which is used for
+// the sliding expiry.
+type FileSessionStorage struct {
+	dir         string
+	ttl         int64
+	maxLifetime int64
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+type wtkFileSessionData struct {
+	Created int64             `json:"created"`
+	Data    map[string]string `json:"data"`
+}
+
+// NewFileSessionStorage creates a storage in dir, SessionFileDir is used
+// when dir is empty. Register it with RegisterSessionStore.
+func NewFileSessionStorage(dir string) *FileSessionStorage {
+	return &FileSessionStorage{dir: dir}
+}
+
+func (this *FileSessionStorage) Init(ttl int64) {
+	if this.stop != nil {
+		return
+	}
+	if this.dir == "" {
+		this.dir = SessionFileDir
+	}
+	if this.dir == "" {
+		this.dir = filepath.Join(AppRoot, "sessions")
+	}
+	this.ttl = ttl
+	this.maxLifetime = SessionMaxLifetime
+	os.MkdirAll(this.dir, 0700)
+	this.stop = make(chan struct{})
+	interval := SessionGCInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	go this.gc(time.Duration(interval) * time.Second)
+}
+
+// Close stops the cleanup goroutine.
+func (this *FileSessionStorage) Close() error {
+	if this.stop == nil {
+		return nil
+	}
+	this.stopOnce.Do(func() {
+		close(this.stop)
+	})
+	return nil
+}
+
+func validSessionId(sid string) bool {
+	if len(sid) < 4 || len(sid) > 128 {
+		return false
+	}
+	for _, c := range sid {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *FileSessionStorage) path(sid string) (string, string, error) {
+	if !validSessionId(sid) {
+		return "", "", errors.New("invalid session id")
+	}
+	shardDir := filepath.Join(this.dir, sid[:2])
+	return shardDir, filepath.Join(shardDir, sid), nil
+}
+
+// lock locks the shard directory and returns the function that unlocks it.
+func (this *FileSessionStorage) lock(shardDir string, exclusive bool) (func(), error) {
+	if err := os.MkdirAll(shardDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(shardDir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+func (this *FileSessionStorage) expired(info os.FileInfo, created int64, now time.Time) bool {
+	if info.ModTime().Unix()+this.ttl <= now.Unix() {
+		return true
+	}
+	return this.maxLifetime > 0 && created > 0 && created+this.maxLifetime <= now.Unix()
+}
+
+func (this *FileSessionStorage) read(file string) (*wtkFileSessionData, os.FileInfo, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &wtkFileSessionData{}
+	if err := json.Unmarshal(content, d); err != nil {
+		return nil, nil, err
+	}
+	if d.Data == nil {
+		d.Data = make(map[string]string)
+	}
+	return d, info, nil
+}
+
+func (this *FileSessionStorage) write(shardDir string, file string, d *wtkFileSessionData) error {
+	content, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(shardDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (this *FileSessionStorage) CreateSessionID() string {
+	return util.randomId(32)
+}
+
+func (this *FileSessionStorage) Load(ctx context.Context, sid string) (map[string]string, error) {
+	shardDir, file, err := this.path(sid)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	unlock, err := this.lock(shardDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	d, info, err := this.read(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if this.expired(info, d.Created, now) {
+		return nil, ErrSessionNotFound
+	}
+	if err := os.Chtimes(file, now, now); err != nil {
+		return d.Data, err
+	}
+	return d.Data, nil
+}
+
+func (this *FileSessionStorage) Save(ctx context.Context, sid string, data map[string]string) error {
+	shardDir, file, err := this.path(sid)
+	if err != nil {
+		return err
+	}
+	unlock, err := this.lock(shardDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	d := &wtkFileSessionData{Created: time.Now().Unix(), Data: data}
+	if old, _, err := this.read(file); err == nil && old.Created > 0 {
+		d.Created = old.Created
+	}
+	return this.write(shardDir, file, d)
+}
+
+func (this *FileSessionStorage) Destroy(ctx context.Context, sid string) error {
+	shardDir, file, err := this.path(sid)
+	if err != nil {
+		return nil
+	}
+	unlock, err := this.lock(shardDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (this *FileSessionStorage) Touch(ctx context.Context, sid string) error {
+	_, err := this.Load(ctx, sid)
+	return err
+}
+
+func (this *FileSessionStorage) Exists(sid string) bool {
+	shardDir, file, err := this.path(sid)
+	if err != nil {
+		return false
+	}
+	unlock, err := this.lock(shardDir, false)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+	d, info, err := this.read(file)
+	return err == nil && !this.expired(info, d.Created, time.Now())
+}
+
+func (this *FileSessionStorage) Set(sid string, data map[string]string) {
+	this.Save(context.Background(), sid, data)
+}
+
+func (this *FileSessionStorage) Get(sid string) map[string]string {
+	data, _ := this.Load(context.Background(), sid)
+	if data == nil {
+		return make(map[string]string)
+	}
+	return data
+}
+
+func (this *FileSessionStorage) Delete(sid string) {
+	this.Destroy(context.Background(), sid)
+}
+
+// UserSessions reads every session file, so it gets slow with a lot of sessions.
+func (this *FileSessionStorage) UserSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	shards, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := []SessionInfo{}
+	now := time.Now()
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		shardDir := filepath.Join(this.dir, shard.Name())
+		files, err := ioutil.ReadDir(shardDir)
+		if err != nil {
+			continue
+		}
+		unlock, err := this.lock(shardDir, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if !validSessionId(name) {
+				continue
+			}
+			d, info, err := this.read(filepath.Join(shardDir, name))
+			if err != nil || this.expired(info, d.Created, now) || d.Data[sessionUserKey] != userId {
+				continue
+			}
+			infos = append(infos, newSessionInfo(name, d.Data, d.Created, info.ModTime().Unix()))
+		}
+		unlock()
+	}
+	return infos, nil
+}
+
+func (this *FileSessionStorage) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			this.cleanup()
+		}
+	}
+}
+
+// cleanup removes expired sessions and temporary files left by a crash.
+func (this *FileSessionStorage) cleanup() {
+	shards, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		return
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		shardDir := filepath.Join(this.dir, shard.Name())
+		files, err := ioutil.ReadDir(shardDir)
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		unlock, err := this.lock(shardDir, true)
+		if err != nil {
+			continue
+		}
+		for _, info := range files {
+			name := info.Name()
+			file := filepath.Join(shardDir, name)
+			if strings.HasPrefix(name, ".tmp-") {
+				if info.ModTime().Unix()+this.ttl <= now.Unix() {
+					os.Remove(file)
+				}
+				continue
+			}
+			if !validSessionId(name) {
+				continue
+			}
+			d, info, err := this.read(file)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				os.Remove(file)
+				continue
+			}
+			if this.expired(info, d.Created, now) {
+				os.Remove(file)
+			}
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,246 @@
+package wtk
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const sessionStorageShards = 32
+
+// wtkDefaultSessionStorage keeps sessions in memory. The sessions are spread
+// over shards with their own lock, and every Get and Set works on a copy of
+// the data so that concurrent requests never share a map.
+type wtkDefaultSessionStorage struct {
+	// count and seq are first for the alignment of atomic access.
+	count       int64
+	seq         int64
+	ttl         int64
+	maxLifetime int64
+	maxCount    int
+	shards      []*wtkDefaultSessionShard
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// Every session expires ttl after its last use, so the order list of a
+// shard, most recently used first, is also its order of expiry.
+type wtkDefaultSessionShard struct {
+	lock  sync.Mutex
+	datas map[string]*wtkDefaultSessionStorageData
+	order *list.List
+}
+
+type wtkDefaultSessionStorageData struct {
+	created int64
+	expires int64
+	// seq orders the last uses across the shards.
+	seq  int64
+	elem *list.Element
+	data map[string]string
+}
+
+func copySessionData(data map[string]string) map[string]string {
+	c := make(map[string]string, len(data))
+	for k, v := range data {
+		c[k] = v
+	}
+	return c
+}
+
+func (this *wtkDefaultSessionStorage) Init(ttl int64) {
+	if this.shards != nil {
+		return
+	}
+	this.ttl = ttl
+	this.maxLifetime = SessionMaxLifetime
+	this.maxCount = SessionMaxCount
+	this.shards = make([]*wtkDefaultSessionShard, sessionStorageShards)
+	for i := range this.shards {
+		this.shards[i] = &wtkDefaultSessionShard{datas: make(map[string]*wtkDefaultSessionStorageData), order: list.New()}
+	}
+	this.stop = make(chan struct{})
+	interval := SessionGCInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	go this.gc(time.Duration(interval) * time.Second)
+}
+
+// Close stops the gc goroutine.
+func (this *wtkDefaultSessionStorage) Close() {
+	if this.stop == nil {
+		return
+	}
+	this.stopOnce.Do(func() {
+		close(this.stop)
+	})
+}
+
+func (this *wtkDefaultSessionStorage) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			now := time.Now().Unix()
+			for _, shard := range this.shards {
+				shard.lock.Lock()
+				for sid, d := range shard.datas {
+					if !this.alive(d, now) {
+						this.remove(shard, sid)
+					}
+				}
+				shard.lock.Unlock()
+			}
+		}
+	}
+}
+
+func (this *wtkDefaultSessionStorage) shard(sid string) *wtkDefaultSessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return this.shards[h.Sum32()%uint32(len(this.shards))]
+}
+
+func (this *wtkDefaultSessionStorage) alive(d *wtkDefaultSessionStorageData, now int64) bool {
+	if d.expires <= now {
+		return false
+	}
+	if this.maxLifetime > 0 && d.created+this.maxLifetime <= now {
+		return false
+	}
+	return true
+}
+
+// touch moves a session to the front of the order of its shard, the
+// caller must hold the shard lock.
+func (this *wtkDefaultSessionStorage) touch(shard *wtkDefaultSessionShard, d *wtkDefaultSessionStorageData, now int64) {
+	d.expires = now + this.ttl
+	d.seq = atomic.AddInt64(&this.seq, 1)
+	shard.order.MoveToFront(d.elem)
+}
+
+// remove deletes a session and keeps the count, the caller must hold the
+// shard lock.
+func (this *wtkDefaultSessionStorage) remove(shard *wtkDefaultSessionShard, sid string) {
+	if d, ok := shard.datas[sid]; ok {
+		delete(shard.datas, sid)
+		shard.order.Remove(d.elem)
+		atomic.AddInt64(&this.count, -1)
+	}
+}
+
+// evict drops the sessions that expire first until there are at most
+// maxCount, keep is the session just added. Only the last session of each
+// shard is looked at, the shards are locked one at a time, so the caller
+// must not hold a shard lock.
+func (this *wtkDefaultSessionStorage) evict(keep string) {
+	for atomic.LoadInt64(&this.count) > int64(this.maxCount) {
+		var victimShard *wtkDefaultSessionShard
+		victim := ""
+		var seq int64
+		for _, shard := range this.shards {
+			shard.lock.Lock()
+			e := shard.order.Back()
+			if e != nil && e.Value.(string) == keep {
+				e = e.Prev()
+			}
+			if e != nil {
+				sid := e.Value.(string)
+				if d := shard.datas[sid]; victim == "" || d.seq < seq {
+					victimShard, victim, seq = shard, sid, d.seq
+				}
+			}
+			shard.lock.Unlock()
+		}
+		if victimShard == nil {
+			return
+		}
+		victimShard.lock.Lock()
+		this.remove(victimShard, victim)
+		victimShard.lock.Unlock()
+	}
+}
+
+func (this *wtkDefaultSessionStorage) CreateSessionID() string {
+	return util.randomId(32)
+}
+
+func (this *wtkDefaultSessionStorage) Exists(sid string) bool {
+	shard := this.shard(sid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	d, exist := shard.datas[sid]
+	return exist && this.alive(d, time.Now().Unix())
+}
+
+func (this *wtkDefaultSessionStorage) Set(sid string, data map[string]string) {
+	shard := this.shard(sid)
+	shard.lock.Lock()
+	now := time.Now().Unix()
+	if d, exist := shard.datas[sid]; exist {
+		this.touch(shard, d, now)
+		d.data = copySessionData(data)
+		shard.lock.Unlock()
+		return
+	}
+	shard.datas[sid] = &wtkDefaultSessionStorageData{
+		created: now,
+		expires: now + this.ttl,
+		seq:     atomic.AddInt64(&this.seq, 1),
+		elem:    shard.order.PushFront(sid),
+		data:    copySessionData(data),
+	}
+	count := atomic.AddInt64(&this.count, 1)
+	shard.lock.Unlock()
+
+	if this.maxCount > 0 && count > int64(this.maxCount) {
+		this.evict(sid)
+	}
+}
+
+func (this *wtkDefaultSessionStorage) Get(sid string) map[string]string {
+	shard := this.shard(sid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	now := time.Now().Unix()
+	if d, exist := shard.datas[sid]; exist {
+		if this.alive(d, now) {
+			this.touch(shard, d, now)
+			return copySessionData(d.data)
+		}
+		this.remove(shard, sid)
+	}
+	return make(map[string]string)
+}
+
+func (this *wtkDefaultSessionStorage) UserSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	infos := []SessionInfo{}
+	now := time.Now().Unix()
+	for _, shard := range this.shards {
+		shard.lock.Lock()
+		for sid, d := range shard.datas {
+			if d.data[sessionUserKey] == userId && this.alive(d, now) {
+				infos = append(infos, newSessionInfo(sid, d.data, d.created, d.expires-this.ttl))
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return infos, nil
+}
+
+func (this *wtkDefaultSessionStorage) Delete(sid string) {
+	shard := this.shard(sid)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	this.remove(shard, sid)
+}
@@ -0,0 +1,318 @@
+package wtk
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SQLDialectGeneric  = ""
+	SQLDialectSQLite   = "sqlite"
+	SQLDialectPostgres = "postgres"
+	SQLDialectMySQL    = "mysql"
+)
+
+var sqlIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLSessionStorage keeps sessions in a database/sql table, so they can be
+// shared by several app servers. The dialect selects the placeholder style
+// and the upsert statement, the generic dialect updates first and inserts
+// when no row was updated, retrying the update if a concurrent insert won.
+type SQLSessionStorage struct {
+	db          *sql.DB
+	dialect     string
+	table       string
+	ttl         int64
+	maxLifetime int64
+	stop        chan struct{}
+	stopOnce    sync.Once
+	tableLock   sync.Mutex
+	tableErr    error
+}
+
+func NewSQLSessionStorage(db *sql.DB, dialect string, table string) *SQLSessionStorage {
+	if table == "" {
+		table = "wtk_sessions"
+	}
+	if !sqlIdentifierRegexp.MatchString(table) {
+		panic("invalid session table name: " + table)
+	}
+	return &SQLSessionStorage{db: db, dialect: dialect, table: table}
+}
+
+func (this *SQLSessionStorage) Init(ttl int64) {
+	if this.stop != nil {
+		return
+	}
+	this.ttl = ttl
+	this.maxLifetime = SessionMaxLifetime
+	this.stop = make(chan struct{})
+	if err := this.CreateTable(); err != nil {
+		log.Println("wtk: session table:", err)
+		this.tableErr = err
+	}
+	interval := SessionGCInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	go this.gc(time.Duration(interval) * time.Second)
+}
+
+// Close stops the cleanup goroutine, the database is left open.
+func (this *SQLSessionStorage) Close() error {
+	if this.stop == nil {
+		return nil
+	}
+	this.stopOnce.Do(func() {
+		close(this.stop)
+	})
+	return nil
+}
+
+// query replaces the ? placeholders for dialects that number them.
+func (this *SQLSessionStorage) query(q string) string {
+	q = strings.Replace(q, "{table}", this.table, -1)
+	if this.dialect != SQLDialectPostgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// CreateTable creates the session table and its indexes. Tables created
+// before user sessions were added need the user_id column added by hand.
+func (this *SQLSessionStorage) CreateTable() error {
+	_, err := this.db.Exec(this.query(`CREATE TABLE IF NOT EXISTS {table} (
+	id VARCHAR(128) NOT NULL PRIMARY KEY,
+	data TEXT NOT NULL,
+	created BIGINT NOT NULL,
+	expires BIGINT NOT NULL,
+	user_id VARCHAR(128) NOT NULL DEFAULT ''
+)`))
+	if err != nil {
+		return err
+	}
+	// Not every database supports IF NOT EXISTS on indexes,
+	// an error here only means the index exists already.
+	this.db.Exec(this.query(`CREATE INDEX {table}_expires ON {table} (expires)`))
+	this.db.Exec(this.query(`CREATE INDEX {table}_user_id ON {table} (user_id)`))
+	return nil
+}
+
+// ready creates the table again if it failed in Init, its error is
+// returned by the storage calls so that SessionFailurePolicy applies.
+func (this *SQLSessionStorage) ready() error {
+	this.tableLock.Lock()
+	defer this.tableLock.Unlock()
+	if this.tableErr != nil {
+		this.tableErr = this.CreateTable()
+	}
+	return this.tableErr
+}
+
+func (this *SQLSessionStorage) CreateSessionID() string {
+	return util.randomId(32)
+}
+
+func (this *SQLSessionStorage) alive(created int64, expires int64, now int64) bool {
+	if expires <= now {
+		return false
+	}
+	return this.maxLifetime <= 0 || created+this.maxLifetime > now
+}
+
+func (this *SQLSessionStorage) load(ctx context.Context, sid string, touch bool) (map[string]string, error) {
+	if err := this.ready(); err != nil {
+		return nil, err
+	}
+	var data string
+	var created, expires int64
+	row := this.db.QueryRowContext(ctx, this.query(`SELECT data, created, expires FROM {table} WHERE id = ?`), sid)
+	if err := row.Scan(&data, &created, &expires); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if !this.alive(created, expires, now) {
+		return nil, ErrSessionNotFound
+	}
+	m := make(map[string]string)
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+	if touch {
+		if _, err := this.db.ExecContext(ctx, this.query(`UPDATE {table} SET expires = ? WHERE id = ?`), now+this.ttl, sid); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func (this *SQLSessionStorage) save(ctx context.Context, sid string, data map[string]string) error {
+	if err := this.ready(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	userId := data[sessionUserKey]
+	now := time.Now().Unix()
+	expires := now + this.ttl
+	switch this.dialect {
+	case SQLDialectSQLite, SQLDialectPostgres:
+		_, err = this.db.ExecContext(ctx, this.query(`INSERT INTO {table} (id, data, created, expires, user_id) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires = excluded.expires, user_id = excluded.user_id`), sid, string(b), now, expires, userId)
+		return err
+	case SQLDialectMySQL:
+		_, err = this.db.ExecContext(ctx, this.query(`INSERT INTO {table} (id, data, created, expires, user_id) VALUES (?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE data = VALUES(data), expires = VALUES(expires), user_id = VALUES(user_id)`), sid, string(b), now, expires, userId)
+		return err
+	}
+	update := func() (bool, error) {
+		res, err := this.db.ExecContext(ctx, this.query(`UPDATE {table} SET data = ?, expires = ?, user_id = ? WHERE id = ?`), string(b), expires, userId, sid)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n > 0, err
+	}
+	if ok, err := update(); ok || err != nil {
+		return err
+	}
+	_, err = this.db.ExecContext(ctx, this.query(`INSERT INTO {table} (id, data, created, expires, user_id) VALUES (?, ?, ?, ?, ?)`), sid, string(b), now, expires, userId)
+	if err != nil {
+		// Another server inserted the row in the meantime.
+		if ok, uerr := update(); ok {
+			return nil
+		} else if uerr != nil {
+			return uerr
+		}
+	}
+	return err
+}
+
+func (this *SQLSessionStorage) destroy(ctx context.Context, sid string) error {
+	if err := this.ready(); err != nil {
+		return err
+	}
+	_, err := this.db.ExecContext(ctx, this.query(`DELETE FROM {table} WHERE id = ?`), sid)
+	return err
+}
+
+func (this *SQLSessionStorage) Load(ctx context.Context, sid string) (map[string]string, error) {
+	return this.load(ctx, sid, true)
+}
+
+func (this *SQLSessionStorage) Save(ctx context.Context, sid string, data map[string]string) error {
+	return this.save(ctx, sid, data)
+}
+
+func (this *SQLSessionStorage) Destroy(ctx context.Context, sid string) error {
+	return this.destroy(ctx, sid)
+}
+
+func (this *SQLSessionStorage) Touch(ctx context.Context, sid string) error {
+	if err := this.ready(); err != nil {
+		return err
+	}
+	_, err := this.db.ExecContext(ctx, this.query(`UPDATE {table} SET expires = ? WHERE id = ?`), time.Now().Unix()+this.ttl, sid)
+	return err
+}
+
+func (this *SQLSessionStorage) Exists(sid string) bool {
+	_, err := this.load(context.Background(), sid, false)
+	return err == nil
+}
+
+func (this *SQLSessionStorage) Set(sid string, data map[string]string) {
+	this.save(context.Background(), sid, data)
+}
+
+func (this *SQLSessionStorage) Get(sid string) map[string]string {
+	// The data is still returned when only refreshing the expiry failed.
+	data, _ := this.load(context.Background(), sid, true)
+	if data == nil {
+		return make(map[string]string)
+	}
+	return data
+}
+
+func (this *SQLSessionStorage) Delete(sid string) {
+	this.destroy(context.Background(), sid)
+}
+
+func (this *SQLSessionStorage) UserSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	if err := this.ready(); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	rows, err := this.db.QueryContext(ctx, this.query(`SELECT id, data, created, expires FROM {table} WHERE user_id = ? AND expires > ?`), userId, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	infos := []SessionInfo{}
+	for rows.Next() {
+		var sid, data string
+		var created, expires int64
+		if err := rows.Scan(&sid, &data, &created, &expires); err != nil {
+			return nil, err
+		}
+		if !this.alive(created, expires, now) {
+			continue
+		}
+		m := make(map[string]string)
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			continue
+		}
+		infos = append(infos, newSessionInfo(sid, m, created, expires-this.ttl))
+	}
+	return infos, rows.Err()
+}
+
+// Cleanup deletes the expired rows.
+func (this *SQLSessionStorage) Cleanup() error {
+	if err := this.ready(); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err := this.db.Exec(this.query(`DELETE FROM {table} WHERE expires <= ?`), now)
+	if err == nil && this.maxLifetime > 0 {
+		_, err = this.db.Exec(this.query(`DELETE FROM {table} WHERE created <= ?`), now-this.maxLifetime)
+	}
+	return err
+}
+
+func (this *SQLSessionStorage) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			if err := this.Cleanup(); err != nil {
+				log.Println("wtk: session cleanup:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package wtk
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	sessionUserKey      = "_user"
+	sessionIPKey        = "_ip"
+	sessionUserAgentKey = "_ua"
+	sessionCreatedKey   = "_created"
+)
+
+// sessionUserKeys hold the user binding next to the values of the session,
+// Keys, Set, Delete and Clear leave them alone.
+var sessionUserKeys = map[string]bool{
+	sessionUserKey:      true,
+	sessionIPKey:        true,
+	sessionUserAgentKey: true,
+	sessionCreatedKey:   true,
+}
+
+var ErrSessionUserUnsupported = errors.New("session store cannot list the sessions of a user")
+
+// SessionInfo describes a session bound to a user with Session.SetUser.
+type SessionInfo struct {
+	Id        string
+	UserId    string
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+}
+
+// SessionUserStoreInterface can be implemented by a store that can find the
+// sessions bound to a user, which keep the user ID under the "_user" key.
+// Only sessions that have not expired are returned.
+type SessionUserStoreInterface interface {
+	UserSessions(ctx context.Context, userId string) ([]SessionInfo, error)
+}
+
+func newSessionInfo(sid string, data map[string]string, created int64, lastSeen int64) SessionInfo {
+	if v, err := strconv.ParseInt(data[sessionCreatedKey], 10, 64); err == nil {
+		created = v
+	}
+	return SessionInfo{
+		Id:        sid,
+		UserId:    data[sessionUserKey],
+		Created:   time.Unix(created, 0),
+		LastSeen:  time.Unix(lastSeen, 0),
+		IP:        data[sessionIPKey],
+		UserAgent: data[sessionUserAgentKey],
+	}
+}
+
+func sortSessionInfos(infos []SessionInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastSeen.After(infos[j].LastSeen)
+	})
+}
+
+func (this *wtkSessionManager) UserSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	this.checkInit()
+	s, ok := this.storage.(SessionUserStoreInterface)
+	if !ok {
+		return nil, ErrSessionUserUnsupported
+	}
+	if userId == "" {
+		return []SessionInfo{}, nil
+	}
+	infos, err := s.UserSessions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	sortSessionInfos(infos)
+	return infos, nil
+}
+
+// RevokeUserSessions destroys the sessions of a user except the one with the
+// ID except.
+func (this *wtkSessionManager) RevokeUserSessions(ctx context.Context, userId string, except string) error {
+	infos, err := this.UserSessions(ctx, userId)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Id == except {
+			continue
+		}
+		if err := this.Destroy(ctx, info.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackClient keeps the client address and user agent of a user session
+// up to date, the session is only saved when they changed.
+func (this *Session) trackClient() {
+	if this.data[sessionUserKey] == "" {
+		return
+	}
+	ip := this.hdlr.Context.remoteIP()
+	ua := this.hdlr.Context.Request.UserAgent()
+	if this.data[sessionIPKey] != ip || this.data[sessionUserAgentKey] != ua {
+		this.data[sessionIPKey] = ip
+		this.data[sessionUserAgentKey] = ua
+		this.dirty = true
+	}
+}
+
+// SetUser binds the session to a user, so that it can be listed and revoked
+// together with the other sessions of the user. On login call Regenerate first.
+func (this *Session) SetUser(userId string) {
+	this.init()
+	this.data[sessionUserKey] = userId
+	if _, ok := this.data[sessionCreatedKey]; !ok {
+		this.data[sessionCreatedKey] = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	this.dirty = true
+	this.trackClient()
+}
+
+func (this *Session) UserId() string {
+	this.init()
+	return this.data[sessionUserKey]
+}
+
+// UserSessions lists the sessions of the user of this session,
+// the most recently used first.
+func (this *Session) UserSessions() ([]SessionInfo, error) {
+	return this.sessionManager.UserSessions(this.context(), this.UserId())
+}
+
+// RevokeSession destroys another session of the user of this session.
+func (this *Session) RevokeSession(sid string) error {
+	infos, err := this.UserSessions()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Id == sid {
+			return this.sessionManager.Destroy(this.context(), sid)
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// RevokeOtherSessions destroys every session of the user but this one,
+// as in "log out of all other devices".
+func (this *Session) RevokeOtherSessions() error {
+	return this.sessionManager.RevokeUserSessions(this.context(), this.UserId(), this.Id())
+}
@@ -1,31 +1,46 @@
 package wtk
 
 import (
+	"errors"
 	"html/template"
 	"io/ioutil"
+	"sync"
 )
 
 var tplFuncMap template.FuncMap
 var tplVars map[string]interface{}
+var tplLock sync.RWMutex
 
 func init() {
 	tplFuncMap = make(template.FuncMap)
 	tplVars = make(map[string]interface{})
 }
 
+// AddTemplateFunc adds a func to the templates of every server,
+// see Server.AddTemplateFunc for a single server.
 func AddTemplateFunc(name string, tplFunc interface{}) {
+	tplLock.Lock()
+	defer tplLock.Unlock()
 	tplFuncMap[name] = tplFunc
 }
 
+// SetTemplateVar sets a var of the templates of every server,
+// see Server.SetTemplateVar for a single server.
 func SetTemplateVar(name string, value interface{}) {
+	tplLock.Lock()
+	defer tplLock.Unlock()
 	tplVars[name] = value
 }
 
 type Template struct {
 	hdlr      *Handler
-	tpl       *template.Template
+	tpl       TemplateExecutor
+	engine    TemplateEngine
 	vars      map[string]interface{}
 	tplResult *wtkTemplateResult
+	sources   map[string]string
+	err       error
+	block     string
 }
 
 func (this *Template) SetVar(name string, value interface{}) {
@@ -45,26 +60,170 @@ func (this *Template) GetVar(name string) interface{} {
 	return nil
 }
 
+// requestFuncMap returns the template functions bound to the current request.
+func (this *Template) requestFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"flashes": func() []string {
+			return this.hdlr.Session.Flashes()
+		},
+		"csrf_token": func() string {
+			return this.hdlr.Context.CsrfToken()
+		},
+		"csrf_field": func() template.HTML {
+			return this.hdlr.Context.CsrfField()
+		},
+		"T": func(key string, args ...interface{}) string {
+			return this.hdlr.Context.T(key, args...)
+		},
+		"locale": func() string {
+			return this.hdlr.Context.Locale()
+		},
+	}
+}
+
+// offlineFuncMap returns the funcs of requestFuncMap for templates rendered
+// outside a request, T uses the locale.
+func offlineFuncMap(server *Server, locale string) template.FuncMap {
+	if locale == "" {
+		locale = DefaultLocale
+	}
+	return template.FuncMap{
+		"flashes": func() []string {
+			return nil
+		},
+		"csrf_token": func() string {
+			return ""
+		},
+		"csrf_field": func() template.HTML {
+			return ""
+		},
+		"T": func(key string, args ...interface{}) string {
+			return server.i18n.translate(locale, key, args...)
+		},
+		"locale": func() string {
+			return locale
+		},
+		"mail_inline": func(path string) (template.URL, error) {
+			return "", errors.New("mail_inline: only mail templates can inline files")
+		},
+	}
+}
+
+// templateFuncMap returns the built-in funcs of the server, the funcs of
+// AddTemplateFunc, those of Server.AddTemplateFunc and the funcs bound to
+// the request, in the order they override each other.
+func templateFuncMap(server *Server, requestFuncs template.FuncMap) map[string]interface{} {
+	funcs := make(map[string]interface{}, len(server.tplFuncs)+len(tplFuncMap)+3)
+	for name, f := range server.tplFuncs {
+		funcs[name] = f
+	}
+	tplLock.RLock()
+	for name, f := range tplFuncMap {
+		funcs[name] = f
+	}
+	tplLock.RUnlock()
+	server.tplConfig.lock.RLock()
+	for name, f := range server.tplConfig.funcs {
+		funcs[name] = f
+	}
+	server.tplConfig.lock.RUnlock()
+	for name, f := range requestFuncs {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+func (this *Template) funcMap() map[string]interface{} {
+	return templateFuncMap(this.hdlr.server, this.requestFuncMap())
+}
+
+// SetEngine sets the engine for SetTemplateString and SetTemplateFile,
+// by default files are rendered by the engine of their extension and
+// strings by html/template.
+func (this *Template) SetEngine(engine TemplateEngine) {
+	this.engine = engine
+}
+
+func (this *Template) getEngine() TemplateEngine {
+	if this.engine != nil {
+		return this.engine
+	}
+	return this.hdlr.server.templateEngine(HTMLTemplateEngine{})
+}
+
+// Err returns the last parse or execute error.
+func (this *Template) Err() error {
+	return this.err
+}
+
+// source returns the text of a template for error reports.
+func (this *Template) source(name string) string {
+	if src, ok := this.sources[name]; ok {
+		return src
+	}
+	return this.hdlr.server.templates.source(name)
+}
+
+func (this *Template) addSource(name string, str string) {
+	if this.sources == nil {
+		this.sources = make(map[string]string)
+	}
+	this.sources[name] = str
+}
+
+func (this *Template) setError(err error) bool {
+	this.tpl = nil
+	this.err = newTemplateError(err, this.source)
+	return false
+}
+
 func (this *Template) SetTemplateString(str string) bool {
-	this.tpl = template.New("")
-	this.tpl.Funcs(tplFuncMap).Parse(str)
+	this.addSource("", str)
+	tpl, err := this.getEngine().Parse("", str, this.funcMap())
+	if err != nil {
+		return this.setError(err)
+	}
+	this.tpl = tpl
 	return true
 }
 
-func (this *Template) SetTemplateFile(filename string) bool {
-	content, err := ioutil.ReadFile(filename)
+// use binds a compiled template to the funcs of the request.
+func (this *Template) use(tpl TemplateExecutor, err error) bool {
 	if err != nil {
-		return false
+		return this.setError(err)
+	}
+	tpl, err = tpl.Bind(this.funcMap())
+	if err != nil {
+		return this.setError(err)
 	}
-	return this.SetTemplateString(string(content))
+	this.tpl = tpl
+	return true
+}
+
+// SetTemplateFile uses the template of the server's template directory with
+// the name filename if there is one, otherwise the file is read and kept
+// compiled by the server.
+func (this *Template) SetTemplateFile(filename string) bool {
+	return this.use(this.hdlr.server.templateFile(filename, this.engine))
+}
+
+// SetTemplateName uses a template of the directory loaded by Server.LoadTemplates.
+func (this *Template) SetTemplateName(name string) bool {
+	return this.use(this.hdlr.server.templates.Lookup(name))
 }
 
 func (this *Template) SetSubTemplateString(name, str string) bool {
 	if this.tpl == nil {
 		return false
 	}
-	tpl := this.tpl.New(name)
-	tpl.Funcs(tplFuncMap).Parse(`{{define "` + name + `"}}` + str + `{{end}}`)
+	this.addSource(name, str)
+	definer, ok := this.tpl.(templateDefiner)
+	if !ok {
+		return this.setError(errTemplateNoSubTemplates)
+	}
+	if err := definer.Define(name, str, this.funcMap()); err != nil {
+		return this.setError(err)
+	}
 	return true
 }
 
@@ -76,8 +235,14 @@ func (this *Template) SetSubTemplateFile(name, filename string) bool {
 	return this.SetSubTemplateString(name, string(content))
 }
 
+// Parse executes the template. A failure answers the request with 500,
+// see Context.Err.
 func (this *Template) Parse() bool {
 	if this.tpl == nil {
+		if this.err != nil && this.tplResult == nil {
+			this.tplResult = &wtkTemplateResult{data: []byte{}}
+			this.hdlr.Context.fail(this.err)
+		}
 		return false
 	}
 	if this.tplResult != nil {
@@ -92,18 +257,29 @@ func (this *Template) Parse() bool {
 	if this.vars == nil {
 		this.vars = make(map[string]interface{})
 	}
-	for n, v := range tplVars {
+	for n, v := range this.hdlr.server.templateVars() {
 		if _, ok := this.vars[n]; !ok {
 			this.vars[n] = v
 		}
 	}
 	this.tplResult = &wtkTemplateResult{data: []byte{}}
-	err := this.tpl.Execute(this.tplResult, this.vars)
+	err := this.execute(this.tplResult)
 	if err != nil {
+		this.err = newTemplateError(err, this.source)
+		this.tplResult.SetBytes([]byte{})
+		this.hdlr.Context.fail(this.err)
 		return false
 	}
 
 	this.hdlr.callHandlerHook("AfterRender")
+	if this.hdlr.Context.response.Finished {
+		return true
+	}
+	if err := this.hdlr.server.filters.apply(this); err != nil {
+		this.tplResult.SetBytes([]byte{})
+		this.hdlr.Context.fail(err)
+		return false
+	}
 	return true
 }
 
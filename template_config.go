@@ -0,0 +1,120 @@
+package wtk
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// wtkTemplateConfig is the template configuration of a server, it is used
+// together with the package level AddTemplateFunc, SetTemplateVar and
+// TemplateDir, and overrides them.
+type wtkTemplateConfig struct {
+	lock       sync.RWMutex
+	funcs      map[string]interface{}
+	vars       map[string]interface{}
+	leftDelim  string
+	rightDelim string
+	dir        string
+}
+
+func newTemplateConfig() *wtkTemplateConfig {
+	return &wtkTemplateConfig{
+		funcs: make(map[string]interface{}),
+		vars:  make(map[string]interface{}),
+	}
+}
+
+// AddTemplateFunc adds a func to the templates of the server. Funcs used by
+// the templates of LoadTemplates must be added before they are loaded.
+func (this *Server) AddTemplateFunc(name string, tplFunc interface{}) {
+	this.tplConfig.lock.Lock()
+	defer this.tplConfig.lock.Unlock()
+	this.tplConfig.funcs[name] = tplFunc
+}
+
+// SetTemplateVar sets a var of the templates of the server, it overrides
+// a var of SetTemplateVar by the same name.
+func (this *Server) SetTemplateVar(name string, value interface{}) {
+	this.tplConfig.lock.Lock()
+	defer this.tplConfig.lock.Unlock()
+	this.tplConfig.vars[name] = value
+}
+
+// SetTemplateDelims sets the action delimiters of the templates of the
+// server whose engine supports them, empty delimiters are {{ and }}.
+// It must be called before LoadTemplates.
+func (this *Server) SetTemplateDelims(left string, right string) {
+	this.tplConfig.lock.Lock()
+	defer this.tplConfig.lock.Unlock()
+	this.tplConfig.leftDelim = left
+	this.tplConfig.rightDelim = right
+}
+
+// SetTemplateDir sets the template directory of the server, which is
+// loaded by Run. The default is TemplateDir.
+func (this *Server) SetTemplateDir(dir string) {
+	this.tplConfig.lock.Lock()
+	defer this.tplConfig.lock.Unlock()
+	this.tplConfig.dir = dir
+}
+
+func (this *Server) templateDir() string {
+	this.tplConfig.lock.RLock()
+	defer this.tplConfig.lock.RUnlock()
+	if this.tplConfig.dir != "" {
+		return this.tplConfig.dir
+	}
+	return TemplateDir
+}
+
+// templateEngine returns engine with the delimiters of the server.
+func (this *Server) templateEngine(engine TemplateEngine) TemplateEngine {
+	this.tplConfig.lock.RLock()
+	left, right := this.tplConfig.leftDelim, this.tplConfig.rightDelim
+	this.tplConfig.lock.RUnlock()
+	if left == "" && right == "" {
+		return engine
+	}
+	if e, ok := engine.(TemplateDelimsEngine); ok {
+		return e.WithDelims(left, right)
+	}
+	return engine
+}
+
+// templateVars returns the vars of SetTemplateVar overridden by those of
+// the server.
+func (this *Server) templateVars() map[string]interface{} {
+	tplLock.RLock()
+	vars := make(map[string]interface{}, len(tplVars))
+	for n, v := range tplVars {
+		vars[n] = v
+	}
+	tplLock.RUnlock()
+	this.tplConfig.lock.RLock()
+	for n, v := range this.tplConfig.vars {
+		vars[n] = v
+	}
+	this.tplConfig.lock.RUnlock()
+	return vars
+}
+
+// templateDirPath returns dir relative to AppRoot.
+func templateDirPath(dir string) string {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(AppRoot, dir)
+	}
+	return dir
+}
+
+// templateFile returns the template of the template directory with the name
+// filename if there is one, otherwise the file compiled by engine, or by
+// the engine of its extension when engine is nil.
+func (this *Server) templateFile(filename string, engine TemplateEngine) (TemplateExecutor, error) {
+	if this.templates.Has(filename) && engine == nil {
+		return this.templates.Lookup(filename)
+	}
+	if engine == nil {
+		engine = this.templateEngine(templateEngineFor(filename))
+	}
+	return this.templates.File(filename, engine)
+}
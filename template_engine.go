@@ -0,0 +1,179 @@
+package wtk
+
+import (
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// TemplateEngine compiles the text of a template. The funcs are those of
+// AddTemplateFunc together with the funcs bound to the request.
+type TemplateEngine interface {
+	Parse(name string, text string, funcs map[string]interface{}) (TemplateExecutor, error)
+}
+
+// TemplateExecutor is a compiled template.
+type TemplateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+	// Bind returns a copy of the template that uses funcs, compiled templates
+	// are cached and bound to the funcs of every request.
+	Bind(funcs map[string]interface{}) (TemplateExecutor, error)
+}
+
+// TemplateDelimsEngine is implemented by engines whose action delimiters
+// can be changed, see Server.SetTemplateDelims.
+type TemplateDelimsEngine interface {
+	WithDelims(left string, right string) TemplateEngine
+}
+
+// templateDefiner is implemented by executors that support named sub
+// templates, see Template.SetSubTemplateString.
+type templateDefiner interface {
+	Define(name string, text string, funcs map[string]interface{}) error
+}
+
+var (
+	tplEngines     = make(map[string]TemplateEngine)
+	tplEnginesLock sync.RWMutex
+)
+
+func init() {
+	RegisterTemplateEngine(".html", HTMLTemplateEngine{})
+	RegisterTemplateEngine(".tpl", HTMLTemplateEngine{})
+	RegisterTemplateEngine(".txt", TextTemplateEngine{})
+	RegisterTemplateEngine(".mustache", MustacheTemplateEngine{})
+	RegisterTemplateEngine(".md", MarkdownTemplateEngine{})
+}
+
+// RegisterTemplateEngine sets the engine for template files with the
+// extension ext, such as ".txt".
+func RegisterTemplateEngine(ext string, engine TemplateEngine) {
+	tplEnginesLock.Lock()
+	defer tplEnginesLock.Unlock()
+	tplEngines[strings.ToLower(ext)] = engine
+}
+
+// templateEngineFor returns the engine of a file, html/template is used
+// for unknown extensions.
+func templateEngineFor(filename string) TemplateEngine {
+	tplEnginesLock.RLock()
+	defer tplEnginesLock.RUnlock()
+	if engine, ok := tplEngines[strings.ToLower(filepath.Ext(filename))]; ok {
+		return engine
+	}
+	return HTMLTemplateEngine{}
+}
+
+func isHTMLTemplateEngine(engine TemplateEngine) bool {
+	_, ok := engine.(HTMLTemplateEngine)
+	return ok
+}
+
+// defineText wraps text in a define action using the delimiters.
+func defineText(left string, right string, name string, text string) string {
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	return left + `define "` + name + `"` + right + text + left + "end" + right
+}
+
+// HTMLTemplateEngine is the default engine, it uses html/template.
+// Empty delimiters are the default {{ and }}.
+type HTMLTemplateEngine struct {
+	LeftDelim  string
+	RightDelim string
+}
+
+func (this HTMLTemplateEngine) WithDelims(left string, right string) TemplateEngine {
+	return HTMLTemplateEngine{LeftDelim: left, RightDelim: right}
+}
+
+func (this HTMLTemplateEngine) Parse(name string, text string, funcs map[string]interface{}) (TemplateExecutor, error) {
+	tpl, err := htmltemplate.New(name).Delims(this.LeftDelim, this.RightDelim).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &wtkHTMLTemplate{tpl: tpl, engine: this}, nil
+}
+
+type wtkHTMLTemplate struct {
+	tpl    *htmltemplate.Template
+	engine HTMLTemplateEngine
+}
+
+func (this *wtkHTMLTemplate) Execute(w io.Writer, data interface{}) error {
+	return this.tpl.Execute(w, data)
+}
+
+func (this *wtkHTMLTemplate) Bind(funcs map[string]interface{}) (TemplateExecutor, error) {
+	tpl, err := this.tpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &wtkHTMLTemplate{tpl: tpl.Funcs(funcs), engine: this.engine}, nil
+}
+
+func (this *wtkHTMLTemplate) Define(name string, text string, funcs map[string]interface{}) error {
+	e := this.engine
+	_, err := this.tpl.New(name).Delims(e.LeftDelim, e.RightDelim).Funcs(funcs).Parse(defineText(e.LeftDelim, e.RightDelim, name, text))
+	return err
+}
+
+// TextTemplateEngine uses text/template, which does not escape the output.
+// It is meant for plain text such as emails.
+type TextTemplateEngine struct {
+	LeftDelim  string
+	RightDelim string
+}
+
+func (this TextTemplateEngine) WithDelims(left string, right string) TemplateEngine {
+	return TextTemplateEngine{LeftDelim: left, RightDelim: right}
+}
+
+func (this TextTemplateEngine) Parse(name string, text string, funcs map[string]interface{}) (TemplateExecutor, error) {
+	tpl, err := texttemplate.New(name).Delims(this.LeftDelim, this.RightDelim).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &wtkTextTemplate{tpl: tpl, engine: this}, nil
+}
+
+type wtkTextTemplate struct {
+	tpl    *texttemplate.Template
+	engine TextTemplateEngine
+}
+
+func (this *wtkTextTemplate) Execute(w io.Writer, data interface{}) error {
+	return this.tpl.Execute(w, data)
+}
+
+func (this *wtkTextTemplate) Bind(funcs map[string]interface{}) (TemplateExecutor, error) {
+	tpl, err := this.tpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &wtkTextTemplate{tpl: tpl.Funcs(funcs), engine: this.engine}, nil
+}
+
+func (this *wtkTextTemplate) Define(name string, text string, funcs map[string]interface{}) error {
+	e := this.engine
+	_, err := this.tpl.New(name).Delims(e.LeftDelim, e.RightDelim).Funcs(funcs).Parse(defineText(e.LeftDelim, e.RightDelim, name, text))
+	return err
+}
+
+func (this *wtkHTMLTemplate) ExecuteBlock(w io.Writer, name string, data interface{}) error {
+	return this.tpl.ExecuteTemplate(w, name, data)
+}
+
+func (this *wtkTextTemplate) ExecuteBlock(w io.Writer, name string, data interface{}) error {
+	return this.tpl.ExecuteTemplate(w, name, data)
+}
+
+var errTemplateNoSubTemplates = errors.New("template: the engine does not support sub templates")
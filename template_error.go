@@ -0,0 +1,135 @@
+package wtk
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var tplErrorRegexp = regexp.MustCompile(`^(?:html/)?template: ?([^:]*)(?::(\d+))?(?::(\d+))?: (?:executing "[^"]*" at <(.*)>: )?(?s:(.*))$`)
+
+// TemplateError is the parse or execute error of a template.
+type TemplateError struct {
+	// Name is the template that failed, the path relative to the template
+	// directory for templates loaded by Server.LoadTemplates.
+	Name   string
+	Line   int
+	Column int
+	// Action is the failing action, such as {{.User.Name}}.
+	Action string
+	// Message is the error without the location.
+	Message string
+	// Source is the text of the template when it is known.
+	Source string
+	Err    error
+}
+
+func (this *TemplateError) Error() string {
+	return this.Err.Error()
+}
+
+func (this *TemplateError) Unwrap() error {
+	return this.Err
+}
+
+func newTemplateError(err error, source func(name string) string) *TemplateError {
+	if te, ok := err.(*TemplateError); ok {
+		if te.Source == "" && source != nil {
+			te.Source = source(te.Name)
+		}
+		return te
+	}
+	te := &TemplateError{Message: err.Error(), Err: err}
+	if m := tplErrorRegexp.FindStringSubmatch(err.Error()); m != nil {
+		te.Name = m[1]
+		te.Line, _ = strconv.Atoi(m[2])
+		te.Column, _ = strconv.Atoi(m[3])
+		if m[4] != "" {
+			te.Action = "{{" + m[4] + "}}"
+		}
+		te.Message = m[5]
+	}
+	if source != nil {
+		te.Source = source(te.Name)
+	}
+	return te
+}
+
+// Snippet returns the lines of the source around the failing line.
+func (this *TemplateError) Snippet(context int) (first int, lines []string) {
+	if this.Source == "" || this.Line <= 0 {
+		return 0, nil
+	}
+	all := strings.Split(this.Source, "\n")
+	if this.Line > len(all) {
+		return 0, nil
+	}
+	first = this.Line - context
+	if first < 1 {
+		first = 1
+	}
+	last := this.Line + context
+	if last > len(all) {
+		last = len(all)
+	}
+	return first, all[first-1 : last]
+}
+
+var tplErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Template error</title>
+<style>body{font-family:sans-serif;margin:2em}pre{background:#f6f6f6;padding:1em;overflow:auto}.line{color:#999}.fail{background:#fdd;display:block}</style>
+</head><body>
+<h1>Template error</h1>
+<p><b>{{.Name}}{{if .Line}}:{{.Line}}{{if .Column}}:{{.Column}}{{end}}{{end}}</b></p>
+{{if .Action}}<p>at <code>{{.Action}}</code></p>{{end}}
+<p>{{.Message}}</p>
+{{if .Lines}}<pre>{{range .Lines}}<span class="{{if .Fail}}fail{{end}}"><span class="line">{{printf "%4d" .No}}</span>  {{.Text}}</span>
+{{end}}</pre>{{end}}
+</body></html>`))
+
+type wtkTemplateErrorLine struct {
+	No   int
+	Text string
+	Fail bool
+}
+
+func (this *TemplateError) page() string {
+	data := struct {
+		*TemplateError
+		Lines []wtkTemplateErrorLine
+	}{TemplateError: this}
+	first, lines := this.Snippet(5)
+	for i, text := range lines {
+		no := first + i
+		data.Lines = append(data.Lines, wtkTemplateErrorLine{No: no, Text: text, Fail: no == this.Line})
+	}
+	var b strings.Builder
+	tplErrorPage.Execute(&b, data)
+	return b.String()
+}
+
+// Err returns the error that failed the request with 500, such as a
+// TemplateError. It can be used in the HttpStatus500 hook.
+func (this *Context) Err() error {
+	return this.response.err
+}
+
+// fail logs the error and answers the request with 500 through the
+// HttpStatus500 hook. Without a hook the details of a TemplateError are
+// only shown when AppEnv is set to development.
+func (this *Context) fail(err error) {
+	log.Println("wtk:", err)
+	if this.response.isClosed() {
+		return
+	}
+	this.response.err = err
+	content := http.StatusText(http.StatusInternalServerError)
+	if te, ok := err.(*TemplateError); ok && AppEnv == EnvDevelopment {
+		content = te.page()
+		this.SetHeader("Content-Type", "text/html; charset=utf-8")
+	}
+	this.Abort(http.StatusInternalServerError, content)
+}
@@ -0,0 +1,66 @@
+package wtk
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// templateBlockExecutor is implemented by executors that can render one
+// of their named templates, see Template.RenderBlock.
+type templateBlockExecutor interface {
+	ExecuteBlock(w io.Writer, name string, data interface{}) error
+}
+
+var errTemplateNoBlocks = errors.New("template: the engine does not support blocks")
+
+// RenderBlock renders only the block or define name of the template
+// instead of the whole page, such as a block of the layout or one added
+// with SetSubTemplateString.
+func (this *Template) RenderBlock(name string) {
+	this.block = name
+}
+
+// SetFragment renders only the block name when the request has the
+// FragmentHeader header, as sent by htmx, and the whole page otherwise.
+// It reports whether the block is rendered.
+func (this *Template) SetFragment(name string) bool {
+	if FragmentHeader == "" {
+		return false
+	}
+	this.hdlr.Context.AddHeader("Vary", FragmentHeader)
+	if !this.hdlr.Context.IsFragment() {
+		return false
+	}
+	this.RenderBlock(name)
+	return true
+}
+
+// IsFragment reports whether the request asks for a part of a page with the
+// FragmentHeader header.
+func (this *Context) IsFragment() bool {
+	if FragmentHeader == "" {
+		return false
+	}
+	v := strings.TrimSpace(this.Request.Header.Get(FragmentHeader))
+	return v != "" && !strings.EqualFold(v, "false")
+}
+
+func (this *Template) execute(w io.Writer) error {
+	if this.block == "" {
+		return this.tpl.Execute(w, this.vars)
+	}
+	tpl, ok := this.tpl.(templateBlockExecutor)
+	if !ok {
+		return errTemplateNoBlocks
+	}
+	return tpl.ExecuteBlock(w, this.block, this.vars)
+}
+
+func (this *wtkHTMLTemplate) hasBlock(name string) bool {
+	return this.tpl.Lookup(name) != nil
+}
+
+func (this *wtkTextTemplate) hasBlock(name string) bool {
+	return this.tpl.Lookup(name) != nil
+}
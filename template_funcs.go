@@ -0,0 +1,266 @@
+package wtk
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var routeParamRegexp = regexp.MustCompile(`\{\w+?\(.*?\)\}|\{\w+?\}`)
+
+// Name names the route for Server.URLFor and the urlfor template func.
+func (this *Route) Name(name string) {
+	this.router.lock.Lock()
+	defer this.router.lock.Unlock()
+	this.router.namedRoutes[name] = this
+}
+
+// URLFor builds the path of a named route. The args are pairs of a name and
+// a value, values of the route's path vars are put in the path and the
+// others in the query string.
+func (this *wtkRouter) URLFor(name string, args ...interface{}) (string, error) {
+	this.lock.Lock()
+	route, ok := this.namedRoutes[name]
+	this.lock.Unlock()
+	if !ok {
+		return "", errors.New("urlfor: no route named " + name)
+	}
+	if len(args)%2 != 0 {
+		return "", errors.New("urlfor: odd number of arguments")
+	}
+	values := make(map[string]string)
+	keys := []string{}
+	for i := 0; i < len(args); i += 2 {
+		key := fmt.Sprint(args[i])
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = fmt.Sprint(args[i+1])
+	}
+
+	var err error
+	used := make(map[string]bool)
+	path := routeParamRegexp.ReplaceAllStringFunc(route.pattern, func(m string) string {
+		m = m[1 : len(m)-1]
+		param, re := m, "[^/]+"
+		if i := strings.Index(m, "("); i >= 0 {
+			param, re = m[:i], m[i:]
+		}
+		value, ok := values[param]
+		if !ok {
+			err = errors.New("urlfor: missing value for " + param + " of route " + name)
+			return ""
+		}
+		if matched, _ := regexp.MatchString("^(?:"+re+")$", value); !matched {
+			err = errors.New("urlfor: value " + strconv.Quote(value) + " does not match " + param + " of route " + name)
+			return ""
+		}
+		used[param] = true
+		return url.PathEscape(value)
+	})
+	if err != nil {
+		return "", err
+	}
+	query := make(url.Values)
+	for _, key := range keys {
+		if !used[key] {
+			query.Add(key, values[key])
+		}
+	}
+	path = this.PrefixPath + path
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path, nil
+}
+
+type wtkStaticFile struct {
+	version string
+	modTime time.Time
+}
+
+// wtkStaticVersions keeps the content hashes of static files for cache busting.
+type wtkStaticVersions struct {
+	lock  sync.Mutex
+	files map[string]*wtkStaticFile
+}
+
+func (this *wtkStaticVersions) version(path string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	f, ok := this.files[path]
+	if ok && AppEnv != EnvDevelopment {
+		return f.version
+	}
+	filename := filepath.Join(AppRoot, filepath.FromSlash(path))
+	info, err := os.Stat(filename)
+	if err != nil {
+		return ""
+	}
+	if ok && f.modTime.Equal(info.ModTime()) {
+		return f.version
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(content)
+	f = &wtkStaticFile{version: hex.EncodeToString(sum[:4]), modTime: info.ModTime()}
+	this.files[path] = f
+	return f.version
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case *time.Time:
+		if t != nil {
+			return *t, true
+		}
+	case int64:
+		return time.Unix(t, 0), true
+	case int:
+		return time.Unix(int64(t), 0), true
+	}
+	return time.Time{}, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.String:
+		f, err := strconv.ParseFloat(rv.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// formatNumber formats n with thousands separators and the given decimals.
+func formatNumber(v interface{}, decimals ...int) string {
+	n, ok := toFloat(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	d := 0
+	if len(decimals) > 0 && decimals[0] > 0 {
+		d = decimals[0]
+	}
+	s := strconv.FormatFloat(math.Abs(n), 'f', d, 64)
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i:]
+	}
+	var b strings.Builder
+	if n < 0 && strings.Trim(s, "0.") != "" {
+		b.WriteByte('-')
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteString(frac)
+	return b.String()
+}
+
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	truth, ok := template.IsTrue(v)
+	return ok && !truth
+}
+
+// builtinTemplateFuncs returns the funcs every template of the server has.
+func builtinTemplateFuncs(server *Server) map[string]interface{} {
+	return map[string]interface{}{
+		"urlfor": func(name string, args ...interface{}) (string, error) {
+			return server.router.URLFor(name, args...)
+		},
+		"static": func(path string) string {
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			u := server.router.PrefixPath + path
+			if v := server.static.version(path); v != "" {
+				u += "?v=" + v
+			}
+			return u
+		},
+		"date": func(layout string, v interface{}) string {
+			t, ok := toTime(v)
+			if !ok || t.IsZero() {
+				return ""
+			}
+			return t.Format(layout)
+		},
+		"number": formatNumber,
+		"truncate": func(n int, s string) string {
+			if utf8.RuneCountInString(s) <= n {
+				return s
+			}
+			return string([]rune(s)[:n]) + "…"
+		},
+		"pluralize": func(n interface{}, singular string, plural string) string {
+			if f, ok := toFloat(n); ok && f == 1 {
+				return singular
+			}
+			return plural
+		},
+		"safe_html": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		"safe_js": func(s string) template.JS {
+			return template.JS(s)
+		},
+		"safe_url": func(s string) template.URL {
+			return template.URL(s)
+		},
+		"json": func(v interface{}) (template.JS, error) {
+			b, err := json.Marshal(v)
+			return template.JS(b), err
+		},
+		"default": func(def interface{}, v interface{}) interface{} {
+			if isEmptyValue(v) {
+				return def
+			}
+			return v
+		},
+		"dict": func(pairs ...interface{}) (map[string]interface{}, error) {
+			if len(pairs)%2 != 0 {
+				return nil, errors.New("dict: odd number of arguments")
+			}
+			m := make(map[string]interface{}, len(pairs)/2)
+			for i := 0; i < len(pairs); i += 2 {
+				m[fmt.Sprint(pairs[i])] = pairs[i+1]
+			}
+			return m, nil
+		},
+		"list": func(items ...interface{}) []interface{} {
+			return items
+		},
+	}
+}
@@ -0,0 +1,354 @@
+package wtk
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// MarkdownTemplateEngine renders content pages written in Markdown.
+// The text is first executed as a text/template, so vars and funcs work as
+// in other templates, then converted to HTML. Raw HTML in the Markdown is
+// escaped, and only http, https, mailto and relative links are kept.
+type MarkdownTemplateEngine struct {
+	LeftDelim  string
+	RightDelim string
+}
+
+func (this MarkdownTemplateEngine) WithDelims(left string, right string) TemplateEngine {
+	return MarkdownTemplateEngine{LeftDelim: left, RightDelim: right}
+}
+
+func (this MarkdownTemplateEngine) Parse(name string, text string, funcs map[string]interface{}) (TemplateExecutor, error) {
+	tpl, err := texttemplate.New(name).Delims(this.LeftDelim, this.RightDelim).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &wtkMarkdownTemplate{tpl: tpl}, nil
+}
+
+type wtkMarkdownTemplate struct {
+	tpl *texttemplate.Template
+}
+
+func (this *wtkMarkdownTemplate) Execute(w io.Writer, data interface{}) error {
+	var b bytes.Buffer
+	if err := this.tpl.Execute(&b, data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, MarkdownToHTML(b.String()))
+	return err
+}
+
+func (this *wtkMarkdownTemplate) ExecuteBlock(w io.Writer, name string, data interface{}) error {
+	var b bytes.Buffer
+	if err := this.tpl.ExecuteTemplate(&b, name, data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, MarkdownToHTML(b.String()))
+	return err
+}
+
+func (this *wtkMarkdownTemplate) Bind(funcs map[string]interface{}) (TemplateExecutor, error) {
+	tpl, err := this.tpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &wtkMarkdownTemplate{tpl: tpl.Funcs(funcs)}, nil
+}
+
+var (
+	mdHeadingRegexp   = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdBulletRegexp    = regexp.MustCompile(`^( {0,3})([-*+])\s+`)
+	mdOrderedRegexp   = regexp.MustCompile(`^( {0,3})(\d{1,9})[.)]\s+`)
+	mdImageRegexp     = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]*)(?:\s+&#34;([^&]*)&#34;)?\)`)
+	mdLinkRegexp      = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]*)(?:\s+&#34;([^&]*)&#34;)?\)`)
+	mdAutoLinkRegexp  = regexp.MustCompile(`&lt;((?:https?|mailto):[^\s&]+)&gt;`)
+	mdStrongRegexp    = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdEmRegexp        = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+	mdCodeSpanRegexp  = regexp.MustCompile("(`+)(.+?)(`+)")
+	mdPlaceholderRune = "\x02"
+)
+
+// MarkdownToHTML converts the commonly used subset of Markdown: headings,
+// paragraphs, emphasis, code spans and blocks, block quotes, lists, rules,
+// links and images.
+func MarkdownToHTML(src string) string {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	src = strings.Replace(src, "\t", "    ", -1)
+	var b strings.Builder
+	mdBlocks(&b, strings.Split(src, "\n"))
+	return b.String()
+}
+
+// mdRule reports whether a line is a thematic break, three or more
+// of the same -, * or _ characters.
+func mdRule(line string) bool {
+	s := strings.Replace(strings.TrimSpace(line), " ", "", -1)
+	if len(s) < 3 || strings.IndexByte("-*_", s[0]) < 0 || len(line)-len(strings.TrimLeft(line, " ")) > 3 {
+		return false
+	}
+	return strings.Count(s, s[:1]) == len(s)
+}
+
+func mdBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func mdListMarker(line string) (ordered bool, start int, width int, ok bool) {
+	if m := mdBulletRegexp.FindString(line); m != "" && !mdRule(line) {
+		return false, 0, len(m), true
+	}
+	if m := mdOrderedRegexp.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return true, n, len(m[0]), true
+	}
+	return false, 0, 0, false
+}
+
+func mdBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			i++
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			fence := trimmed[:3]
+			lang := strings.TrimSpace(strings.Trim(trimmed, fence[:1]))
+			i++
+			code := []string{}
+			for ; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			i++
+			if lang != "" {
+				b.WriteString(`<pre><code class="language-` + htmltemplate.HTMLEscapeString(strings.Fields(lang)[0]) + `">`)
+			} else {
+				b.WriteString("<pre><code>")
+			}
+			b.WriteString(htmltemplate.HTMLEscapeString(strings.Join(code, "\n")))
+			if len(code) > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString("</code></pre>\n")
+		case strings.HasPrefix(line, "    "):
+			code := []string{}
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || mdBlank(lines[i])); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			for len(code) > 0 && mdBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>" + htmltemplate.HTMLEscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+		case mdHeadingRegexp.MatchString(trimmed):
+			m := mdHeadingRegexp.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">" + mdInline(m[2]) + "</h" + level + ">\n")
+			i++
+		case mdRule(line):
+			b.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			quote := []string{}
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				l := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(l, " "))
+			}
+			b.WriteString("<blockquote>\n")
+			mdBlocks(b, quote)
+			b.WriteString("</blockquote>\n")
+		default:
+			if ordered, start, _, ok := mdListMarker(line); ok {
+				i = mdList(b, lines, i, ordered, start)
+				continue
+			}
+			para := []string{}
+			for ; i < len(lines); i++ {
+				l := lines[i]
+				t := strings.TrimSpace(l)
+				if t == "" || strings.HasPrefix(t, ">") || strings.HasPrefix(t, "```") || strings.HasPrefix(t, "~~~") ||
+					mdHeadingRegexp.MatchString(t) || mdRule(l) {
+					break
+				}
+				if _, _, _, ok := mdListMarker(l); ok && len(para) > 0 {
+					break
+				}
+				para = append(para, l)
+			}
+			b.WriteString("<p>" + mdParagraph(para) + "</p>\n")
+		}
+	}
+}
+
+// mdList renders the list starting at lines[i] and returns the index of the
+// line after it. An item holds the lines indented under its marker.
+func mdList(b *strings.Builder, lines []string, i int, ordered bool, start int) int {
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	if ordered && start != 1 {
+		b.WriteString(`<ol start="` + strconv.Itoa(start) + `">` + "\n")
+	} else {
+		b.WriteString("<" + tag + ">\n")
+	}
+	items := [][]string{}
+	loose := false
+	for i < len(lines) {
+		o, _, width, ok := mdListMarker(lines[i])
+		if !ok || o != ordered {
+			break
+		}
+		item := []string{lines[i][width:]}
+		i++
+		for i < len(lines) {
+			l := lines[i]
+			if mdBlank(l) {
+				// A blank line continues the item only when indented text follows.
+				if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "  ") {
+					item = append(item, "")
+					loose = true
+					i++
+					continue
+				}
+				if i+1 < len(lines) {
+					if o2, _, _, ok2 := mdListMarker(lines[i+1]); ok2 && o2 == ordered {
+						loose = true
+						i++
+					}
+				}
+				break
+			}
+			if _, _, _, ok := mdListMarker(l); ok && !strings.HasPrefix(l, "  ") {
+				break
+			}
+			item = append(item, mdDedent(l))
+			i++
+		}
+		items = append(items, item)
+	}
+	for _, item := range items {
+		b.WriteString("<li>")
+		if !loose && mdSimpleItem(item) {
+			b.WriteString(mdParagraph(item))
+		} else {
+			var inner strings.Builder
+			mdBlocks(&inner, item)
+			s := inner.String()
+			if !loose && strings.HasPrefix(s, "<p>") {
+				// Tight lists keep the text of the first block unwrapped.
+				end := strings.Index(s, "</p>\n")
+				s = s[3:end] + "\n" + s[end+5:]
+			}
+			b.WriteString(s)
+		}
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func mdDedent(line string) string {
+	n := 0
+	for n < len(line) && n < 4 && line[n] == ' ' {
+		n++
+	}
+	return line[n:]
+}
+
+// mdSimpleItem reports whether an item is just text without nested blocks.
+func mdSimpleItem(item []string) bool {
+	for _, l := range item {
+		t := strings.TrimSpace(l)
+		if t == "" || strings.HasPrefix(t, ">") || strings.HasPrefix(t, "```") || mdHeadingRegexp.MatchString(t) {
+			return false
+		}
+		if _, _, _, ok := mdListMarker(l); ok {
+			return false
+		}
+	}
+	return true
+}
+
+func mdParagraph(lines []string) string {
+	parts := make([]string, len(lines))
+	for i, l := range lines {
+		l = strings.TrimLeft(l, " ")
+		if strings.HasSuffix(l, "  ") && i < len(lines)-1 {
+			parts[i] = mdInline(strings.TrimRight(l, " ")) + "<br>"
+		} else {
+			parts[i] = mdInline(strings.TrimRight(l, " "))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func mdSafeURL(u string) string {
+	lower := strings.ToLower(u)
+	if i := strings.IndexAny(lower, ":/?#"); i >= 0 && lower[i] == ':' {
+		scheme := lower[:i]
+		if scheme != "http" && scheme != "https" && scheme != "mailto" {
+			return "#"
+		}
+	}
+	return u
+}
+
+// mdInline converts the inline elements of a line. Code spans and
+// backslash escapes are replaced by placeholders before the HTML is
+// escaped, so that their content is left alone.
+func mdInline(s string) string {
+	saved := []string{}
+	save := func(html string) string {
+		saved = append(saved, html)
+		return mdPlaceholderRune + strconv.Itoa(len(saved)-1) + mdPlaceholderRune
+	}
+	s = strings.Replace(s, mdPlaceholderRune, "", -1)
+	s = mdCodeSpanRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		sm := mdCodeSpanRegexp.FindStringSubmatch(m)
+		if sm[1] != sm[3] {
+			return m
+		}
+		return save("<code>" + htmltemplate.HTMLEscapeString(strings.TrimSpace(sm[2])) + "</code>")
+	})
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!<>", s[i+1]) >= 0 {
+			b.WriteString(save(htmltemplate.HTMLEscapeString(s[i+1 : i+2])))
+			i++
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	s = htmltemplate.HTMLEscapeString(b.String())
+
+	s = mdImageRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		sm := mdImageRegexp.FindStringSubmatch(m)
+		html := `<img src="` + mdSafeURL(sm[2]) + `" alt="` + sm[1] + `"`
+		if sm[3] != "" {
+			html += ` title="` + sm[3] + `"`
+		}
+		return save(html + ">")
+	})
+	s = mdLinkRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		sm := mdLinkRegexp.FindStringSubmatch(m)
+		html := `<a href="` + mdSafeURL(sm[2]) + `"`
+		if sm[3] != "" {
+			html += ` title="` + sm[3] + `"`
+		}
+		return html + ">" + sm[1] + "</a>"
+	})
+	s = mdAutoLinkRegexp.ReplaceAllString(s, `<a href="$1">$1</a>`)
+	s = mdStrongRegexp.ReplaceAllString(s, "<strong>$1$2</strong>")
+	s = mdEmRegexp.ReplaceAllString(s, "<em>$1$2</em>")
+
+	for i := len(saved) - 1; i >= 0; i-- {
+		s = strings.Replace(s, mdPlaceholderRune+strconv.Itoa(i)+mdPlaceholderRune, saved[i], -1)
+	}
+	return s
+}
@@ -0,0 +1,296 @@
+package wtk
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"reflect"
+	"strings"
+	texttemplate "text/template"
+)
+
+// MustacheTemplateEngine renders Mustache templates: {{name}} is escaped,
+// {{{name}}} and {{&name}} are not, {{#name}}...{{/name}} is a section that
+// repeats for lists and is skipped for false values, {{^name}} is its
+// inverse and {{! }} a comment. Partials and delimiter changes are not
+// supported. Funcs without arguments are called for their value, a func
+// taking a string in a section gets the raw section text.
+type MustacheTemplateEngine struct{}
+
+type wtkMustacheNode struct {
+	kind     byte
+	name     string
+	line     int
+	raw      string
+	children []*wtkMustacheNode
+}
+
+type wtkMustacheTemplate struct {
+	name  string
+	nodes []*wtkMustacheNode
+	funcs map[string]interface{}
+}
+
+func (this MustacheTemplateEngine) Parse(name string, text string, funcs map[string]interface{}) (TemplateExecutor, error) {
+	nodes, err := parseMustache(name, text)
+	if err != nil {
+		return nil, err
+	}
+	return &wtkMustacheTemplate{name: name, nodes: nodes, funcs: funcs}, nil
+}
+
+func mustacheError(name string, line int, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return &TemplateError{
+		Name:    name,
+		Line:    line,
+		Message: msg,
+		Err:     fmt.Errorf("template: %s:%d: %s", name, line, msg),
+	}
+}
+
+// mustacheStandalone reports whether the tag between start and end is alone
+// on its line, and returns the bounds of the line including its newline.
+func mustacheStandalone(text string, start int, end int) (bool, int, int) {
+	ls := strings.LastIndex(text[:start], "\n") + 1
+	if strings.TrimSpace(text[ls:start]) != "" {
+		return false, 0, 0
+	}
+	le := strings.Index(text[end:], "\n")
+	if le < 0 {
+		le = len(text)
+	} else {
+		le += end + 1
+	}
+	if strings.TrimSpace(text[end:le]) != "" {
+		return false, 0, 0
+	}
+	return true, ls, le
+}
+
+func parseMustache(name string, text string) ([]*wtkMustacheNode, error) {
+	root := &wtkMustacheNode{}
+	stack := []*wtkMustacheNode{root}
+	starts := []int{0}
+	pos := 0
+	for {
+		cur := stack[len(stack)-1]
+		i := strings.Index(text[pos:], "{{")
+		if i < 0 {
+			if pos < len(text) {
+				cur.children = append(cur.children, &wtkMustacheNode{kind: 't', raw: text[pos:]})
+			}
+			break
+		}
+		start := pos + i
+		line := strings.Count(text[:start], "\n") + 1
+		closing := "}}"
+		if strings.HasPrefix(text[start:], "{{{") {
+			closing = "}}}"
+		}
+		j := strings.Index(text[start+2:], closing)
+		if j < 0 {
+			return nil, mustacheError(name, line, "unclosed tag")
+		}
+		end := start + 2 + j + len(closing)
+		tag := text[start+2 : start+2+j]
+		kind := byte('v')
+		if closing == "}}}" {
+			kind = '&'
+			tag = tag[1:]
+		} else if len(tag) > 0 && strings.IndexByte("!#^/&>=", tag[0]) >= 0 {
+			kind = tag[0]
+			tag = tag[1:]
+		}
+		tag = strings.TrimSpace(tag)
+
+		textEnd, next := start, end
+		if kind == '!' || kind == '#' || kind == '^' || kind == '/' {
+			if ok, ls, le := mustacheStandalone(text, start, end); ok {
+				textEnd, next = ls, le
+			}
+		}
+		if textEnd > pos {
+			cur.children = append(cur.children, &wtkMustacheNode{kind: 't', raw: text[pos:textEnd]})
+		}
+		pos = next
+
+		switch kind {
+		case '!':
+		case '>', '=':
+			return nil, mustacheError(name, line, "unsupported tag {{%c%s}}", kind, tag)
+		case '#', '^':
+			node := &wtkMustacheNode{kind: kind, name: tag, line: line}
+			cur.children = append(cur.children, node)
+			stack = append(stack, node)
+			starts = append(starts, next)
+		case '/':
+			if len(stack) == 1 || cur.name != tag {
+				return nil, mustacheError(name, line, "unexpected {{/%s}}", tag)
+			}
+			cur.raw = text[starts[len(starts)-1]:textEnd]
+			stack = stack[:len(stack)-1]
+			starts = starts[:len(starts)-1]
+		default:
+			cur.children = append(cur.children, &wtkMustacheNode{kind: kind, name: tag, line: line})
+		}
+	}
+	if len(stack) > 1 {
+		cur := stack[len(stack)-1]
+		return nil, mustacheError(name, cur.line, "unclosed section {{#%s}}", cur.name)
+	}
+	return root.children, nil
+}
+
+func (this *wtkMustacheTemplate) Bind(funcs map[string]interface{}) (TemplateExecutor, error) {
+	return &wtkMustacheTemplate{name: this.name, nodes: this.nodes, funcs: funcs}, nil
+}
+
+func (this *wtkMustacheTemplate) Execute(w io.Writer, data interface{}) error {
+	var b strings.Builder
+	if err := this.render(&b, this.nodes, []interface{}{data}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (this *wtkMustacheTemplate) render(b *strings.Builder, nodes []*wtkMustacheNode, stack []interface{}) error {
+	for _, node := range nodes {
+		switch node.kind {
+		case 't':
+			b.WriteString(node.raw)
+		case 'v', '&':
+			v, err := this.value(node, stack)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				continue
+			}
+			s := fmt.Sprint(v)
+			if node.kind == 'v' {
+				s = htmltemplate.HTMLEscapeString(s)
+			}
+			b.WriteString(s)
+		case '#', '^':
+			v, err := this.value(node, stack)
+			if err != nil {
+				return err
+			}
+			if lambda, ok := v.(func(string) string); ok && node.kind == '#' {
+				nodes, err := parseMustache(this.name, lambda(node.raw))
+				if err != nil {
+					return err
+				}
+				if err := this.render(b, nodes, stack); err != nil {
+					return err
+				}
+				continue
+			}
+			rv := reflect.ValueOf(v)
+			isList := v != nil && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array)
+			truth, _ := texttemplate.IsTrue(v)
+			if node.kind == '^' {
+				if !truth {
+					if err := this.render(b, node.children, stack); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if !truth {
+				continue
+			}
+			if isList {
+				for i := 0; i < rv.Len(); i++ {
+					if err := this.render(b, node.children, append(stack, rv.Index(i).Interface())); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := this.render(b, node.children, append(stack, v)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value looks a dotted name up in the context stack from the top,
+// the funcs are used when no context has it.
+func (this *wtkMustacheTemplate) value(node *wtkMustacheNode, stack []interface{}) (interface{}, error) {
+	if node.name == "." {
+		return stack[len(stack)-1], nil
+	}
+	parts := strings.Split(node.name, ".")
+	for i := len(stack) - 1; i >= 0; i-- {
+		v, ok := mustacheField(stack[i], parts[0])
+		if !ok {
+			continue
+		}
+		for _, part := range parts[1:] {
+			v, _ = mustacheField(v, part)
+		}
+		return v, nil
+	}
+	if f, ok := this.funcs[parts[0]]; ok && len(parts) == 1 {
+		return this.call(node, f)
+	}
+	return nil, nil
+}
+
+func (this *wtkMustacheTemplate) call(node *wtkMustacheNode, f interface{}) (v interface{}, err error) {
+	fv := reflect.ValueOf(f)
+	if fv.Kind() != reflect.Func || fv.Type().NumIn() != 0 {
+		return f, nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = mustacheError(this.name, node.line, "calling %s: %v", node.name, r)
+		}
+	}()
+	out := fv.Call(nil)
+	if len(out) == 0 {
+		return nil, nil
+	}
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, mustacheError(this.name, node.line, "calling %s: %v", node.name, out[1].Interface())
+	}
+	return out[0].Interface(), nil
+}
+
+func mustacheField(v interface{}, name string) (interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, false
+		}
+		if rv.Kind() == reflect.Ptr {
+			if m := rv.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() > 0 {
+				return m.Call(nil)[0].Interface(), true
+			}
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		mv := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !mv.IsValid() {
+			return nil, false
+		}
+		return mv.Interface(), true
+	case reflect.Struct:
+		if f := rv.FieldByName(name); f.IsValid() && f.CanInterface() {
+			return f.Interface(), true
+		}
+		if m := rv.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() > 0 {
+			return m.Call(nil)[0].Interface(), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,327 @@
+package wtk
+
+import (
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A template that starts with {{extends "name"}} is rendered through the
+// named layout, its defines replace the blocks of the layout. The
+// delimiters are those of the server.
+func extendsRegexp(left string, right string) *regexp.Regexp {
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	return regexp.MustCompile(`^\s*` + regexp.QuoteMeta(left) + `-?\s*extends\s+"([^"]+)"\s*-?` + regexp.QuoteMeta(right))
+}
+
+type wtkTemplateSource struct {
+	text    string
+	extends string
+	engine  TemplateEngine
+	modTime time.Time
+}
+
+// wtkTemplateRegistry holds the compiled templates of a directory tree.
+// Templates are named by their slash separated path relative to the
+// directory. The engine of a template is chosen by its extension, those
+// of html/template can extend a layout, and every one that does not extend
+// another can be used by the others as a partial by that name. Compiled
+// templates are never executed, requests work on copies bound to their funcs.
+type wtkTemplateRegistry struct {
+	server    *Server
+	lock      sync.RWMutex
+	dir       string
+	sources   map[string]*wtkTemplateSource
+	compiled  map[string]TemplateExecutor
+	errs      map[string]error
+	checked   time.Time
+	files     map[string]*wtkTemplateFile
+	filesLock sync.Mutex
+}
+
+// wtkTemplateFile is a template loaded with SetTemplateFile.
+type wtkTemplateFile struct {
+	tpl     TemplateExecutor
+	text    string
+	engine  TemplateEngine
+	modTime time.Time
+}
+
+func newTemplateRegistry(server *Server) *wtkTemplateRegistry {
+	return &wtkTemplateRegistry{
+		server:   server,
+		sources:  make(map[string]*wtkTemplateSource),
+		compiled: make(map[string]TemplateExecutor),
+		errs:     make(map[string]error),
+		files:    make(map[string]*wtkTemplateFile),
+	}
+}
+
+func (this *wtkTemplateRegistry) funcs() map[string]interface{} {
+	// The request funcs are replaced on the copy used by a request.
+	return templateFuncMap(this.server, offlineFuncMap(this.server, ""))
+}
+
+func templateExtension(name string) bool {
+	ext := filepath.Ext(name)
+	for _, e := range TemplateExtensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads and compiles every template below dir. Templates that fail
+// to compile are reported by the returned error and by Lookup.
+func (this *wtkTemplateRegistry) Load(dir string) error {
+	dir = templateDirPath(dir)
+	sources, err := this.read(dir)
+	if err != nil {
+		return err
+	}
+	compiled := make(map[string]TemplateExecutor)
+	errs := make(map[string]error)
+	var first error
+	// A template that does not parse on its own is left out of the others,
+	// so that a broken partial only breaks the pages using it.
+	for name, src := range sources {
+		tpl, err := src.engine.Parse(name, src.text, this.funcs())
+		if err != nil {
+			errs[name] = err
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		if !isHTMLTemplateEngine(src.engine) {
+			compiled[name] = tpl
+		}
+	}
+	for name, src := range sources {
+		if errs[name] != nil || !isHTMLTemplateEngine(src.engine) {
+			continue
+		}
+		tpl, err := this.compile(sources, errs, name)
+		if err != nil {
+			errs[name] = err
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		compiled[name] = tpl
+	}
+
+	this.lock.Lock()
+	this.dir = dir
+	this.sources = sources
+	this.compiled = compiled
+	this.errs = errs
+	this.checked = time.Now()
+	this.lock.Unlock()
+	return first
+}
+
+func (this *wtkTemplateRegistry) read(dir string) (map[string]*wtkTemplateSource, error) {
+	sources := make(map[string]*wtkTemplateSource)
+	delims, _ := this.server.templateEngine(HTMLTemplateEngine{}).(HTMLTemplateEngine)
+	extends := extendsRegexp(delims.LeftDelim, delims.RightDelim)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !templateExtension(path) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		src := &wtkTemplateSource{text: string(content), engine: this.server.templateEngine(templateEngineFor(path)), modTime: info.ModTime()}
+		if m := extends.FindStringSubmatchIndex(src.text); m != nil && isHTMLTemplateEngine(src.engine) {
+			src.extends = src.text[m[2]:m[3]]
+			// Keep the line numbers of the rest of the file.
+			src.text = strings.Repeat("\n", strings.Count(src.text[:m[1]], "\n")) + src.text[m[1]:]
+		}
+		sources[filepath.ToSlash(rel)] = src
+		return nil
+	})
+	return sources, err
+}
+
+func (this *wtkTemplateRegistry) compile(sources map[string]*wtkTemplateSource, broken map[string]error, name string) (TemplateExecutor, error) {
+	chain := []string{}
+	inChain := make(map[string]bool)
+	for n := name; n != ""; n = sources[n].extends {
+		if inChain[n] {
+			return nil, errors.New("template: " + name + ": extends loop at " + n)
+		}
+		if _, ok := sources[n]; !ok {
+			return nil, errors.New("template: " + name + ": extends missing template " + n)
+		}
+		if err := broken[n]; err != nil {
+			return nil, err
+		}
+		inChain[n] = true
+		chain = append(chain, n)
+	}
+
+	root := chain[len(chain)-1]
+	engine := sources[root].engine.(HTMLTemplateEngine)
+	tpl := template.New(root).Delims(engine.LeftDelim, engine.RightDelim).Funcs(this.funcs())
+	// Partials are parsed by name, so that of two defines by the same name
+	// always the one of the last file wins.
+	names := make([]string, 0, len(sources))
+	for n, src := range sources {
+		if inChain[n] || src.extends != "" || broken[n] != nil || !isHTMLTemplateEngine(src.engine) {
+			continue
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if _, err := tpl.New(n).Parse(sources[n].text); err != nil {
+			return nil, err
+		}
+	}
+	// The chain is parsed from the root layout down to the template itself,
+	// so that the defines of a template replace the blocks above it.
+	for i := len(chain) - 1; i >= 0; i-- {
+		t := tpl
+		if chain[i] != root {
+			t = tpl.New(chain[i])
+		}
+		if _, err := t.Parse(sources[chain[i]].text); err != nil {
+			return nil, err
+		}
+	}
+	return &wtkHTMLTemplate{tpl: tpl.Lookup(root), engine: engine}, nil
+}
+
+// checkReload reloads the directory in development mode when a template
+// has been added, changed or removed. It checks at most once a second.
+func (this *wtkTemplateRegistry) checkReload() {
+	if AppEnv != EnvDevelopment {
+		return
+	}
+	this.lock.RLock()
+	dir := this.dir
+	due := dir != "" && time.Since(this.checked) >= time.Second
+	this.lock.RUnlock()
+	if !due {
+		return
+	}
+
+	this.lock.Lock()
+	this.checked = time.Now()
+	sources := this.sources
+	this.lock.Unlock()
+
+	changed := false
+	seen := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || changed || info.IsDir() || !templateExtension(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		src, ok := sources[filepath.ToSlash(rel)]
+		if !ok || !src.modTime.Equal(info.ModTime()) {
+			changed = true
+		}
+		seen++
+		return nil
+	})
+	if changed || seen != len(sources) {
+		this.Load(dir)
+	}
+}
+
+// Lookup returns the compiled template of name.
+func (this *wtkTemplateRegistry) Lookup(name string) (TemplateExecutor, error) {
+	this.checkReload()
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if err, ok := this.errs[name]; ok {
+		return nil, err
+	}
+	tpl, ok := this.compiled[name]
+	if !ok {
+		return nil, errors.New("template: no template named " + name)
+	}
+	return tpl, nil
+}
+
+func (this *wtkTemplateRegistry) Has(name string) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	_, ok := this.sources[name]
+	return ok
+}
+
+// File returns the compiled template of a single file, it is read again
+// when it changed in development mode.
+func (this *wtkTemplateRegistry) File(filename string, engine TemplateEngine) (TemplateExecutor, error) {
+	this.filesLock.Lock()
+	defer this.filesLock.Unlock()
+	f, ok := this.files[filename]
+	// Engines need not be comparable, such as an engine func.
+	if ok && !reflect.DeepEqual(f.engine, engine) {
+		ok = false
+	}
+	if ok && AppEnv != EnvDevelopment {
+		return f.tpl, nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if ok && f.modTime.Equal(info.ModTime()) {
+		return f.tpl, nil
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tpl, err := engine.Parse(filename, string(content), this.funcs())
+	if err != nil {
+		return nil, newTemplateError(err, func(string) string { return string(content) })
+	}
+	this.files[filename] = &wtkTemplateFile{tpl: tpl, text: string(content), engine: engine, modTime: info.ModTime()}
+	return tpl, nil
+}
+
+func (this *wtkTemplateRegistry) source(name string) string {
+	this.lock.RLock()
+	src, ok := this.sources[name]
+	this.lock.RUnlock()
+	if ok {
+		return src.text
+	}
+	this.filesLock.Lock()
+	defer this.filesLock.Unlock()
+	if f, ok := this.files[name]; ok {
+		return f.text
+	}
+	return ""
+}
@@ -4,13 +4,17 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strings"
 )
 
 type wtkUtil struct{}
@@ -34,6 +38,29 @@ func (this *wtkUtil) CallMethod(i interface{}, name string, args ...interface{})
 	return false
 }
 
+// headerContainsToken reports whether the comma separated header
+// contains the token, compared case-insensitively.
+func (this *wtkUtil) headerContainsToken(header http.Header, name string, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// randomId returns n random bytes from crypto/rand encoded with base64url,
+// which is safe to use in cookies, URLs and file names.
+func (this *wtkUtil) randomId(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 func (this *wtkUtil) getCookieSig(secret, text string) string {
 	hm := hmac.New(sha1.New, []byte(secret))
 	hm.Write([]byte(text))
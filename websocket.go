@@ -0,0 +1,453 @@
+package wtk
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	WebSocketTextMessage   = 1
+	WebSocketBinaryMessage = 2
+	WebSocketCloseMessage  = 8
+	WebSocketPingMessage   = 9
+	WebSocketPongMessage   = 10
+
+	wsContinuationFrame = 0
+	wsGUID              = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseMessageTooBig   = 1009
+	WebSocketCloseInternalError   = 1011
+)
+
+var ErrWebSocketClosed = errors.New("websocket: connection is closed")
+
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (this *WebSocketCloseError) Error() string {
+	return "websocket: close " + strconv.Itoa(this.Code) + " " + this.Reason
+}
+
+type webSocketHandlerInterface interface {
+	HandlerInterface
+	webSocket() *WebSocketHandler
+	Serve(conn *WebSocketConn)
+}
+
+// WebSocketHandler is embedded by handlers that serve a WebSocket endpoint.
+// A GET request on such a route runs the AfterInit and BeforeMethodGet hooks,
+// then the connection is upgraded and Serve is called with the new connection.
+type WebSocketHandler struct {
+	Handler
+	// Subprotocols are offered to the client in order of preference.
+	Subprotocols []string
+}
+
+func (this *WebSocketHandler) webSocket() *WebSocketHandler {
+	return this
+}
+
+func (this *WebSocketHandler) Serve(conn *WebSocketConn) {
+	conn.Close(WebSocketCloseNormal, "")
+}
+
+func (this *wtkResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := this.writer.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported by the response writer")
+	}
+	this.callHeaderFunc()
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	this.gzipWriter = nil
+	this.recorder = nil
+	this.Close()
+	this.Finished = true
+	return conn, brw, nil
+}
+
+func (this *Context) isWebSocketRequest() bool {
+	return this.Request.Method == "GET" &&
+		util.headerContainsToken(this.Request.Header, "Connection", "upgrade") &&
+		util.headerContainsToken(this.Request.Header, "Upgrade", "websocket")
+}
+
+func (this *Context) checkWebSocketOrigin() bool {
+	origin := this.Request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range WebSocketAllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, this.Request.Host)
+}
+
+// UpgradeWebSocket performs the RFC 6455 opening handshake and returns the
+// connection. On failure an error status is written to the client.
+// Headers set on the response before the upgrade, such as the session cookie,
+// are sent with the handshake response.
+func (this *Context) UpgradeWebSocket(subprotocols ...string) (*WebSocketConn, error) {
+	if !this.isWebSocketRequest() {
+		this.Abort(http.StatusBadRequest, "Bad Request")
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+	if this.Request.Header.Get("Sec-WebSocket-Version") != "13" {
+		this.SetHeader("Sec-WebSocket-Version", "13")
+		this.Abort(http.StatusUpgradeRequired, "Upgrade Required")
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := this.Request.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		this.Abort(http.StatusBadRequest, "Bad Request")
+		return nil, errors.New("websocket: invalid Sec-WebSocket-Key")
+	}
+	if !this.checkWebSocketOrigin() {
+		this.Abort(http.StatusForbidden, "Forbidden")
+		return nil, errors.New("websocket: origin not allowed")
+	}
+
+	protocol := ""
+	if len(subprotocols) > 0 {
+		for _, p := range strings.Split(this.Request.Header.Get("Sec-WebSocket-Protocol"), ",") {
+			p = strings.TrimSpace(p)
+			for _, sp := range subprotocols {
+				if p == sp && protocol == "" {
+					protocol = sp
+				}
+			}
+		}
+	}
+
+	header := this.response.Header()
+	netConn, brw, err := this.response.Hijack()
+	if err != nil {
+		this.Abort(http.StatusInternalServerError, "Internal Server Error")
+		return nil, err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n")
+	if protocol != "" {
+		brw.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Type", "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		for _, v := range values {
+			brw.WriteString(name + ": " + v + "\r\n")
+		}
+	}
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	conn := &WebSocketConn{
+		conn:      netConn,
+		reader:    brw.Reader,
+		writer:    brw.Writer,
+		readLimit: WebSocketMaxMessageSize,
+		Protocol:  protocol,
+	}
+	this.webSocket = conn
+	return conn, nil
+}
+
+type WebSocketConn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	writer      *bufio.Writer
+	writeLock   sync.Mutex
+	readLimit   int64
+	closeSent   bool
+	closed      int32
+	pongHandler func(data []byte)
+	Protocol    string
+}
+
+// SetReadLimit sets the maximum size of a message read from the peer.
+// A message exceeding the limit closes the connection with status 1009.
+func (this *WebSocketConn) SetReadLimit(limit int64) {
+	this.readLimit = limit
+}
+
+func (this *WebSocketConn) SetPongHandler(handler func(data []byte)) {
+	this.pongHandler = handler
+}
+
+func (this *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return this.conn.SetReadDeadline(t)
+}
+
+func (this *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return this.conn.SetWriteDeadline(t)
+}
+
+func (this *WebSocketConn) RemoteAddr() net.Addr {
+	return this.conn.RemoteAddr()
+}
+
+func (this *WebSocketConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(this.reader, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		err = this.fail(WebSocketCloseProtocolError, "reserved bits set")
+		return
+	}
+	opcode = int(head[0] & 0x0f)
+	if head[1]&0x80 == 0 {
+		err = this.fail(WebSocketCloseProtocolError, "frame is not masked")
+		return
+	}
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(this.reader, b[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(this.reader, b[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(b[:]))
+		if length < 0 {
+			err = this.fail(WebSocketCloseProtocolError, "invalid frame length")
+			return
+		}
+	}
+	if opcode >= WebSocketCloseMessage {
+		if !fin || length > 125 {
+			err = this.fail(WebSocketCloseProtocolError, "invalid control frame")
+			return
+		}
+	} else if this.readLimit > 0 && length > this.readLimit {
+		err = this.fail(WebSocketCloseMessageTooBig, "message too big")
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(this.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(this.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next data message. Ping, pong and close frames
+// received in between are handled automatically. When the peer closes the
+// connection a *WebSocketCloseError is returned.
+func (this *WebSocketConn) ReadMessage() (messageType int, data []byte, err error) {
+	if atomic.LoadInt32(&this.closed) != 0 {
+		return 0, nil, ErrWebSocketClosed
+	}
+	messageType = -1
+	for {
+		fin, opcode, payload, err := this.readFrame()
+		if err != nil {
+			atomic.StoreInt32(&this.closed, 1)
+			this.conn.Close()
+			return 0, nil, err
+		}
+		switch opcode {
+		case WebSocketPingMessage:
+			// No pong is sent once the close frame was sent.
+			if err := this.writeFrame(WebSocketPongMessage, payload); err != nil && err != ErrWebSocketClosed {
+				atomic.StoreInt32(&this.closed, 1)
+				this.conn.Close()
+				return 0, nil, err
+			}
+			continue
+		case WebSocketPongMessage:
+			if this.pongHandler != nil {
+				this.pongHandler(payload)
+			}
+			continue
+		case WebSocketCloseMessage:
+			closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+			code := WebSocketCloseNormal
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+				code = closeErr.Code
+			}
+			if len(payload) == 1 || !validCloseCode(code) {
+				code = WebSocketCloseProtocolError
+			}
+			this.Close(code, "")
+			return 0, nil, closeErr
+		case WebSocketTextMessage, WebSocketBinaryMessage:
+			if messageType != -1 {
+				return 0, nil, this.fail(WebSocketCloseProtocolError, "expected continuation frame")
+			}
+			messageType = opcode
+		case wsContinuationFrame:
+			if messageType == -1 {
+				return 0, nil, this.fail(WebSocketCloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, this.fail(WebSocketCloseProtocolError, "unknown opcode")
+		}
+		data = append(data, payload...)
+		if this.readLimit > 0 && int64(len(data)) > this.readLimit {
+			return 0, nil, this.fail(WebSocketCloseMessageTooBig, "message too big")
+		}
+		if fin {
+			break
+		}
+	}
+	if messageType == WebSocketTextMessage && !utf8.Valid(data) {
+		return 0, nil, this.fail(WebSocketCloseInvalidPayload, "invalid utf-8 text")
+	}
+	return messageType, data, nil
+}
+
+func (this *WebSocketConn) ReadText() (string, error) {
+	for {
+		messageType, data, err := this.ReadMessage()
+		if err != nil {
+			return "", err
+		}
+		if messageType == WebSocketTextMessage {
+			return string(data), nil
+		}
+	}
+}
+
+func (this *WebSocketConn) writeFrame(opcode int, payload []byte) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if this.closeSent {
+		return ErrWebSocketClosed
+	}
+	if opcode == WebSocketCloseMessage {
+		this.closeSent = true
+	}
+	length := len(payload)
+	header := []byte{0x80 | byte(opcode), 0}
+	switch {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := this.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := this.writer.Write(payload); err != nil {
+		return err
+	}
+	return this.writer.Flush()
+}
+
+func (this *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != WebSocketTextMessage && messageType != WebSocketBinaryMessage {
+		return errors.New("websocket: invalid message type")
+	}
+	return this.writeFrame(messageType, data)
+}
+
+func (this *WebSocketConn) WriteText(text string) error {
+	return this.writeFrame(WebSocketTextMessage, []byte(text))
+}
+
+func (this *WebSocketConn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("websocket: control frame payload too big")
+	}
+	return this.writeFrame(WebSocketPingMessage, data)
+}
+
+// Close sends a close frame with the given status code and closes the
+// underlying connection.
+func (this *WebSocketConn) Close(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	err := this.writeFrame(WebSocketCloseMessage, payload)
+	atomic.StoreInt32(&this.closed, 1)
+	this.conn.Close()
+	if err == ErrWebSocketClosed {
+		return nil
+	}
+	return err
+}
+
+// validCloseCode reports whether code may be sent in a close frame. Codes
+// below 1000 and 1004 to 1006, 1015 and the unassigned ones are reserved.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func (this *WebSocketConn) fail(code int, reason string) error {
+	this.Close(code, reason)
+	return &WebSocketCloseError{Code: code, Reason: reason}
+}
@@ -5,28 +5,68 @@ import (
 	"path/filepath"
 )
 
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
 var (
-	server            *Server
-	servers           map[int]*Server
-	serverIdGen       *wtkAutoIncr
-	util              *wtkUtil
-	cfg               *wtkConfig
-	cfgFile           string
-	AppRoot           string
-	ListenAddr        string
-	ListenPort        int
-	RunMode           string
-	EnableStats       bool
-	CookieSecret      string
-	SessionName       string
-	SessionTTL        int64
-	EnablePprof       bool
-	EnableGzip        bool
-	EnableRouteCache  bool
-	GzipMinLength     int
-	GzipTypes         []string
-	SslCertificate    string
-	SslCertificateKey string
+	server                  *Server
+	servers                 map[int]*Server
+	serverIdGen             *wtkAutoIncr
+	util                    *wtkUtil
+	cfg                     *wtkConfig
+	cfgFile                 string
+	AppRoot                 string
+	ListenAddr              string
+	ListenPort              int
+	RunMode                 string
+	EnableStats             bool
+	CookieSecret            string
+	SessionName             string
+	SessionTTL              int64
+	EnablePprof             bool
+	EnableGzip              bool
+	EnableRouteCache        bool
+	GzipMinLength           int
+	GzipTypes               []string
+	SslCertificate          string
+	SslCertificateKey       string
+	WebSocketMaxMessageSize int64
+	WebSocketAllowedOrigins []string
+	EnableETag              bool
+	ResponseCacheSize       int
+	ResponseCacheTTL        int64
+	AppEnv                  string
+	CookieOldSecrets        []string
+	CookieBindUserAgent     bool
+	CookieBindIP            bool
+	CookieAllowLegacy       bool
+	CookiePath              string
+	CookieDomain            string
+	CookieSecure            bool
+	CookieHttpOnly          bool
+	CookieSameSite          string
+	CookiePartitioned       bool
+	SessionMaxLifetime      int64
+	SessionGCInterval       int64
+	SessionMaxCount         int
+	SessionFileDir          string
+	SessionFailurePolicy    string
+	EnableCsrf              bool
+	CsrfMode                string
+	CsrfFieldName           string
+	CsrfHeaderName          string
+	CsrfCookieName          string
+	CsrfTrustedOrigins      []string
+	TemplateDir             string
+	TemplateExtensions      []string
+	FragmentHeader          string
+	I18nDir                 string
+	DefaultLocale           string
+	LocaleCookieName        string
+	LocaleQueryParam        string
+	EnableLocalePath        bool
 )
 
 func init() {
@@ -36,21 +76,56 @@ func init() {
 		AppRoot = util.getDefaultRootPath()
 	}
 	defaultCfg := &wtkDefaultConfig{
-		AppRoot:           AppRoot,
-		ListenAddr:        "",
-		ListenPort:        80,
-		RunMode:           "http",
-		EnableStats:       true,
-		CookieSecret:      "foobar",
-		SessionName:       "WTKSESSID",
-		SessionTTL:        60 * 15,
-		EnablePprof:       true,
-		EnableGzip:        true,
-		EnableRouteCache:  true,
-		GzipMinLength:     1024,
-		GzipTypes:         []string{"html", "js", "css", "xml"},
-		SslCertificate:    "",
-		SslCertificateKey: "",
+		AppRoot:                 AppRoot,
+		ListenAddr:              "",
+		ListenPort:              80,
+		RunMode:                 "http",
+		EnableStats:             true,
+		CookieSecret:            defaultCookieSecret,
+		SessionName:             "WTKSESSID",
+		SessionTTL:              60 * 15,
+		EnablePprof:             true,
+		EnableGzip:              true,
+		EnableRouteCache:        true,
+		GzipMinLength:           1024,
+		GzipTypes:               []string{"html", "js", "css", "xml"},
+		SslCertificate:          "",
+		SslCertificateKey:       "",
+		WebSocketMaxMessageSize: 1 << 20,
+		WebSocketAllowedOrigins: []string{},
+		EnableETag:              false,
+		ResponseCacheSize:       1000,
+		ResponseCacheTTL:        60,
+		AppEnv:                  EnvProduction,
+		CookieOldSecrets:        []string{},
+		CookieBindUserAgent:     true,
+		CookieBindIP:            false,
+		CookieAllowLegacy:       true,
+		CookiePath:              "",
+		CookieDomain:            "",
+		CookieSecure:            false,
+		CookieHttpOnly:          false,
+		CookieSameSite:          "lax",
+		CookiePartitioned:       false,
+		SessionMaxLifetime:      0,
+		SessionGCInterval:       60,
+		SessionMaxCount:         0,
+		SessionFileDir:          "",
+		SessionFailurePolicy:    SessionFailOpen,
+		EnableCsrf:              false,
+		CsrfMode:                CsrfModeSession,
+		CsrfFieldName:           "_csrf",
+		CsrfHeaderName:          "X-CSRF-Token",
+		CsrfCookieName:          "_csrf",
+		CsrfTrustedOrigins:      []string{},
+		TemplateDir:             "",
+		TemplateExtensions:      []string{".html", ".tpl", ".txt", ".mustache", ".md"},
+		FragmentHeader:          "HX-Request",
+		I18nDir:                 "",
+		DefaultLocale:           "en",
+		LocaleCookieName:        "lang",
+		LocaleQueryParam:        "lang",
+		EnableLocalePath:        false,
 	}
 
 	cfgFile = filepath.Join(AppRoot, "app.conf")
@@ -127,6 +202,74 @@ func RegisterSessionStorage(storage SessionStorageInterface) {
 	server.RegisterSessionStorage(storage)
 }
 
+func RegisterSessionStore(store SessionStore) {
+	server.RegisterSessionStore(store)
+}
+
+func UserSessions(userId string) ([]SessionInfo, error) {
+	return server.UserSessions(userId)
+}
+
+func RevokeSession(sid string) error {
+	return server.RevokeSession(sid)
+}
+
+func RevokeUserSessions(userId string) error {
+	return server.RevokeUserSessions(userId)
+}
+
+func RegisterResponseCacheStorage(storage ResponseCacheStorageInterface) {
+	server.RegisterResponseCacheStorage(storage)
+}
+
+func InvalidateResponseCache(tags ...string) {
+	server.InvalidateResponseCache(tags...)
+}
+
+func ClearResponseCache() {
+	server.ClearResponseCache()
+}
+
+func URLFor(name string, args ...interface{}) (string, error) {
+	return server.URLFor(name, args...)
+}
+
+func SetTemplateDelims(left string, right string) {
+	server.SetTemplateDelims(left, right)
+}
+
+func LoadTemplates(dir string) error {
+	return server.LoadTemplates(dir)
+}
+
+func LoadLocales(dir string) error {
+	return server.LoadLocales(dir)
+}
+
+func MissingTranslations() map[string][]string {
+	return server.MissingTranslations()
+}
+
+func AddOutputFilter(name string, filter OutputFilter, contentTypes ...string) {
+	server.AddOutputFilter(name, filter, contentTypes...)
+}
+
+func NewRenderer() *Renderer {
+	return server.NewRenderer()
+}
+
+func RenderMail(name string, locale string, vars map[string]interface{}) (*Mail, error) {
+	return server.RenderMail(name, locale, vars)
+}
+
+func SetMailTransport(transport MailTransport) {
+	server.SetMailTransport(transport)
+}
+
+func SendMail(m *Mail) error {
+	return server.SendMail(m)
+}
+
 func Run() error {
 	return server.Run(RunMode, ListenAddr, ListenPort)
 }
@@ -1,14 +1,32 @@
 package wtk
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var testServer *Server
@@ -18,6 +36,18 @@ func init() {
 	testServer.AddRoute("/post", &PostHandler{})
 	testServer.AddRoute("/post/{name([a-zA-Z0-9]+)}-{page([0-9]+)}", &PostHandler{})
 	testServer.AddRoute("/cookie", &CookieHandler{})
+	testServer.AddRoute("/cookie/options", &CookieOptionsHandler{})
+	testServer.AddRoute("/session", &SessionHandler{})
+	testServer.AddRoute("/session/values", &SessionValuesHandler{})
+	testServer.AddRoute("/session/user", &SessionUserHandler{})
+	testServer.AddRoute("/events", &EventsHandler{})
+	testServer.AddRoute("/events/live", &LiveEventsHandler{})
+	testServer.AddRoute("/ws", &EchoSocketHandler{})
+	testServer.AddRoute("/etag", &ETagHandler{}).ETag(true)
+	testServer.AddRoute("/cached", &CachedHandler{}).Cache(&ResponseCacheRule{
+		QueryParams: []string{"page"},
+		Tags:        []string{"posts"},
+	})
 	testServer.AddRoute("/{key(.*)}", &IndexHandler{})
 }
 
@@ -81,7 +111,7 @@ var testData = []*testRequest{
 		200, "Post_Post_fdsa", nil},
 	{"GET", "/cookie",
 		nil, map[string]string{"cookiename": "cookievalue", "securename": "29b5ebdb3686d0250f44929764e9a20b2616558e|0Hlde1JxXYhTO8fOWw=="},
-		200, "cookievalue,securevalue", map[string]string{"newname1": "newvalue1", "newname2": "newvalue2", "securename": "29b5ebdb3686d0250f44929764e9a20b2616558e|0Hlde1JxXYhTO8fOWw=="}},
+		200, "cookievalue,securevalue", map[string]string{"newname1": "newvalue1", "newname2": "newvalue2"}},
 }
 
 func TestRequest(t *testing.T) {
@@ -176,3 +206,1724 @@ func (this *CookieHandler) Get() {
 	this.Context.SetSecureCookie("securename", "securevalue", 0)
 	this.Context.WriteString(cv + "," + scv)
 }
+
+func TestEventStream(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/events", nil)
+	r.Header.Set("Last-Event-ID", "41")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	testServer.router.ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("want content type text/event-stream, but got '%s'", ct)
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("event stream should not be gzipped")
+	}
+	expected := "id: 42\nevent: update\ndata: line1\ndata: line2\n\n"
+	if body := w.Body.String(); body != expected {
+		t.Fatalf("want body %q, but got %q", expected, body)
+	}
+}
+
+type EventsHandler struct {
+	Handler
+}
+
+func (this *EventsHandler) Get() {
+	es, err := this.Context.EventStream()
+	if err != nil {
+		this.Context.WriteString(err.Error())
+		return
+	}
+	id, _ := strconv.Atoi(es.LastEventId)
+	es.Send(&Event{Id: strconv.Itoa(id + 1), Event: "update", Data: "line1\nline2"})
+}
+
+func TestEventStreamDisconnect(t *testing.T) {
+	ts := httptest.NewServer(testServer.router)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _ := http.NewRequest("GET", ts.URL+"/events/live", nil)
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 7 {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("want the stream to stay open, but got %v after %q", err, lines)
+		}
+		lines = append(lines, line)
+	}
+	want := []string{"retry: 1500\n", "\n", "retry: 2000\n", "data: hello\n", "\n", ": heartbeat\n", "\n"}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Fatalf("want retry, event and heartbeat %q, but got %q", want, lines)
+	}
+
+	cancel()
+	select {
+	case err := <-liveEventsClosed:
+		if err != ErrEventStreamClosed {
+			t.Fatalf("want sends to fail after the client left, but got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("want the stream to be done when the client disconnects")
+	}
+}
+
+var liveEventsClosed = make(chan error, 1)
+
+type LiveEventsHandler struct {
+	Handler
+}
+
+func (this *LiveEventsHandler) Get() {
+	es, err := this.Context.EventStream()
+	if err != nil {
+		this.Context.WriteString(err.Error())
+		return
+	}
+	es.SetRetry(1500)
+	es.Send(&Event{Data: "hello", Retry: 2000})
+	es.Heartbeat(10 * time.Millisecond)
+	<-es.Done()
+	this.Context.WriteString("late")
+	liveEventsClosed <- es.SendData("late")
+}
+
+func TestWebSocket(t *testing.T) {
+	ts := httptest.NewServer(testServer.router)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: " + ts.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("want status 101, but got %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("want accept key 's3pPLMBiTxaQ9kYGzzhZRbK+xOo=', but got '%s'", accept)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	payload := []byte("hello")
+	frame := []byte{0x81, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+
+	head := make([]byte, 2)
+	io.ReadFull(br, head)
+	if head[0] != 0x81 {
+		t.Fatalf("want text frame, but got opcode %x", head[0])
+	}
+	data := make([]byte, head[1])
+	io.ReadFull(br, data)
+	if string(data) != "echo:hello" {
+		t.Fatalf("want message 'echo:hello', but got '%s'", data)
+	}
+
+	frame = []byte{0x88, 0x82}
+	frame = append(frame, mask...)
+	frame = append(frame, 0x03^mask[0], 0xe8^mask[1])
+	conn.Write(frame)
+	io.ReadFull(br, head)
+	if head[0] != 0x88 {
+		t.Fatalf("want close frame, but got opcode %x", head[0])
+	}
+	data = make([]byte, head[1])
+	io.ReadFull(br, data)
+	if code := binary.BigEndian.Uint16(data); code != 1000 {
+		t.Fatalf("want close code 1000, but got %d", code)
+	}
+
+	// Reserved codes are answered with a protocol error.
+	for _, reserved := range []uint16{999, 1005, 1006, 1015} {
+		conn, br := dialWebSocket(t, ts.Listener.Addr().String())
+		frame = []byte{0x88, 0x82}
+		frame = append(frame, mask...)
+		frame = append(frame, byte(reserved>>8)^mask[0], byte(reserved)^mask[1])
+		conn.Write(frame)
+		io.ReadFull(br, head)
+		data = make([]byte, head[1])
+		io.ReadFull(br, data)
+		conn.Close()
+		if head[0] != 0x88 || len(data) < 2 || binary.BigEndian.Uint16(data) != 1002 {
+			t.Fatalf("want close code 1002 for %d, but got opcode %x '%v'", reserved, head[0], data)
+		}
+	}
+}
+
+func dialWebSocket(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 101 {
+		t.Fatalf("want status 101, but got %v %v", resp, err)
+	}
+	return conn, br
+}
+
+type EchoSocketHandler struct {
+	WebSocketHandler
+}
+
+func (this *EchoSocketHandler) Serve(conn *WebSocketConn) {
+	for {
+		text, err := conn.ReadText()
+		if err != nil {
+			return
+		}
+		conn.WriteText("echo:" + text)
+	}
+}
+
+func TestETag(t *testing.T) {
+	w := request("GET", "/etag", nil, nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || etag == "" {
+		t.Fatalf("want status 200 with an ETag, but got %d '%s'", w.Code, etag)
+	}
+
+	r, _ := http.NewRequest("GET", "/etag", nil)
+	r.Header.Set("If-None-Match", "W/"+etag)
+	w = httptest.NewRecorder()
+	testServer.router.ServeHTTP(w, r)
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Fatalf("want status 304 with empty body, but got %d '%s'", w.Code, w.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "/etag", nil)
+	r.Header.Set("If-None-Match", `"other"`)
+	w = httptest.NewRecorder()
+	testServer.router.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "ETag_Get" {
+		t.Fatalf("want status 200 with body, but got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+type ETagHandler struct {
+	Handler
+}
+
+func (this *ETagHandler) Get() {
+	this.Context.WriteString("ETag_Get")
+}
+
+func TestResponseCache(t *testing.T) {
+	get := func(path string, cacheControl string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		if cacheControl != "" {
+			r.Header.Set("Cache-Control", cacheControl)
+		}
+		w := httptest.NewRecorder()
+		testServer.router.ServeHTTP(w, r)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, body string) {
+		if w.Body.String() != body {
+			t.Fatalf("want body '%s', but got '%s'", body, w.Body.String())
+		}
+	}
+
+	expect(get("/cached?page=1&x=1", ""), "1")
+	w := get("/cached?page=1&x=2", "")
+	expect(w, "1")
+	if w.Header().Get("Age") == "" {
+		t.Fatal("want an Age header on a cache hit")
+	}
+	expect(get("/cached?page=2", ""), "2")
+	expect(get("/cached?page=1", "no-cache"), "3")
+	expect(get("/cached?page=1", ""), "3")
+	testServer.InvalidateResponseCache("posts")
+	expect(get("/cached?page=1", ""), "4")
+
+	calls := cachedHandlerCalls
+	expect(get("/cached?page=empty", ""), "")
+	expect(get("/cached?page=empty", ""), "")
+	if cachedHandlerCalls != calls+2 {
+		t.Fatalf("want empty responses not to be cached, but the handler ran %d times", cachedHandlerCalls-calls)
+	}
+
+	// A session changed after the output is not cached, even when it
+	// needs no new cookie.
+	w = get("/cached?page=session", "")
+	cookies := readSetCookies(w.Header())
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("GET", "/cached?page=session", nil)
+		for k, v := range cookies {
+			r.AddCookie(&http.Cookie{Name: k, Value: v})
+		}
+		w = httptest.NewRecorder()
+		testServer.router.ServeHTTP(w, r)
+		expect(w, strconv.Itoa(calls+4+i))
+	}
+	calls += 3
+
+	r, _ := http.NewRequest("HEAD", "/cached?page=1", nil)
+	w = httptest.NewRecorder()
+	testServer.router.ServeHTTP(w, r)
+	if w.Header().Get("Age") == "" || cachedHandlerCalls != calls+2 {
+		t.Fatal("want HEAD to be answered from the cached GET response")
+	}
+	if key := testServer.cache.key(r, &ResponseCacheRule{}, nil); !strings.HasPrefix(key, "GET /cached?") {
+		t.Fatalf("want the method in the cache key, but got '%s'", key)
+	}
+	r.Method = "POST"
+	if key := testServer.cache.key(r, &ResponseCacheRule{}, nil); !strings.HasPrefix(key, "POST /cached?") {
+		t.Fatalf("want the method in the cache key, but got '%s'", key)
+	}
+}
+
+var cachedHandlerCalls = 0
+
+type CachedHandler struct {
+	Handler
+}
+
+func (this *CachedHandler) Get() {
+	cachedHandlerCalls++
+	if this.Context.GetQueryVar("page") == "empty" {
+		return
+	}
+	this.Context.WriteString(strconv.Itoa(cachedHandlerCalls))
+	if this.Context.GetQueryVar("page") == "session" {
+		this.Session.Set("visited", strconv.Itoa(cachedHandlerCalls))
+	}
+}
+
+func TestSecureCookie(t *testing.T) {
+	legacy := "29b5ebdb3686d0250f44929764e9a20b2616558e|0Hlde1JxXYhTO8fOWw=="
+	w := request("GET", "/cookie", nil, map[string]string{"securename": legacy})
+	if body := w.Body.String(); body != ",securevalue" {
+		t.Fatalf("want legacy cookie to be read, but got '%s'", body)
+	}
+	issued := readSetCookies(w.Header())["securename"]
+	if !strings.HasPrefix(issued, "2|") {
+		t.Fatalf("want cookie in the current format, but got '%s'", issued)
+	}
+
+	w = request("GET", "/cookie", nil, map[string]string{"securename": issued})
+	if body := w.Body.String(); body != ",securevalue" {
+		t.Fatalf("want issued cookie to be read, but got '%s'", body)
+	}
+
+	tampered := issued[:len(issued)-2] + "AA"
+	if tampered == issued {
+		tampered = issued[:len(issued)-2] + "BB"
+	}
+	w = request("GET", "/cookie", nil, map[string]string{"securename": tampered})
+	if body := w.Body.String(); body != "," {
+		t.Fatalf("want tampered cookie to be rejected, but got '%s'", body)
+	}
+
+	oldSecret, oldSecrets := CookieSecret, CookieOldSecrets
+	defer func() {
+		CookieSecret, CookieOldSecrets = oldSecret, oldSecrets
+	}()
+	CookieSecret, CookieOldSecrets = "rotated", []string{oldSecret}
+	w = request("GET", "/cookie", nil, map[string]string{"securename": issued})
+	if body := w.Body.String(); body != ",securevalue" {
+		t.Fatalf("want cookie sealed with an old secret to be read, but got '%s'", body)
+	}
+	if keys := cookieKeys(); len(keys) != 2 || keys[0] != cookieKeys()[0] {
+		t.Fatal("want the cookie keys to be built once per secret")
+	}
+	CookieOldSecrets = nil
+	w = request("GET", "/cookie", nil, map[string]string{"securename": issued})
+	if body := w.Body.String(); body != "," {
+		t.Fatalf("want cookie sealed with a dropped secret to be rejected, but got '%s'", body)
+	}
+
+	defer func(env string) { AppEnv = env }(AppEnv)
+	CookieSecret, AppEnv = defaultCookieSecret, ""
+	if checkCookieSecret() == nil {
+		t.Fatal("want the default secret to be refused without an AppEnv")
+	}
+	AppEnv = EnvDevelopment
+	if err := checkCookieSecret(); err != nil {
+		t.Fatalf("want the default secret in development, but got %v", err)
+	}
+}
+
+func TestCookieOptions(t *testing.T) {
+	w := request("GET", "/cookie/options", nil, nil)
+	cookies := w.Header()["Set-Cookie"]
+	if len(cookies) != 2 {
+		t.Fatalf("want 2 cookies, but got %v", cookies)
+	}
+	host := cookies[0]
+	for _, attr := range []string{"__Host-token=abc", "Path=/;", "Secure", "SameSite=None", "Partitioned"} {
+		if !strings.Contains(host, attr) {
+			t.Fatalf("want cookie '%s' to contain '%s'", host, attr)
+		}
+	}
+	if strings.Contains(host, "Domain=") {
+		t.Fatalf("want __Host- cookie without domain, but got '%s'", host)
+	}
+	if !strings.Contains(cookies[1], "old=;") || !strings.Contains(cookies[1], "Max-Age=0") {
+		t.Fatalf("want deleted cookie, but got '%s'", cookies[1])
+	}
+}
+
+type CookieOptionsHandler struct {
+	Handler
+}
+
+func (this *CookieOptionsHandler) Get() {
+	this.Context.SetCookieWithOptions("__Host-token", "abc", &CookieOptions{
+		Path:        "/admin",
+		Domain:      "example.com",
+		SameSite:    http.SameSiteNoneMode,
+		Partitioned: true,
+	})
+	this.Context.DeleteCookie("old", nil)
+	this.Context.WriteString("ok")
+}
+
+func sessionRequest(path string, sid string) (string, string) {
+	var cookie map[string]string
+	if sid != "" {
+		r, _ := http.NewRequest("GET", path, nil)
+		ctx := &Context{Request: r}
+		cookie = map[string]string{SessionName: ctx.encodeSecureCookie(SessionName, sid, 0)}
+	}
+	w := request("GET", path, nil, cookie)
+	parts := strings.SplitN(w.Body.String(), ",", 2)
+	return parts[0], parts[1]
+}
+
+func TestSessionFixation(t *testing.T) {
+	sid, _ := sessionRequest("/session", "attacker")
+	if sid == "attacker" || len(sid) < 32 {
+		t.Fatalf("want a new random session id, but got '%s'", sid)
+	}
+
+	id, v := sessionRequest("/session?set=foo", sid)
+	if id != sid || v != "foo" {
+		t.Fatalf("want session '%s' with value 'foo', but got '%s' '%s'", sid, id, v)
+	}
+
+	newId, v := sessionRequest("/session?login=1", sid)
+	if newId == sid || v != "foo" {
+		t.Fatalf("want regenerated session with value 'foo', but got '%s' '%s'", newId, v)
+	}
+
+	id, v = sessionRequest("/session", sid)
+	if id == sid || v != "" {
+		t.Fatalf("want old session id to be rejected, but got '%s' '%s'", id, v)
+	}
+	id, v = sessionRequest("/session", newId)
+	if id != newId || v != "foo" {
+		t.Fatalf("want regenerated session to be kept, but got '%s' '%s'", id, v)
+	}
+}
+
+type SessionHandler struct {
+	Handler
+}
+
+func (this *SessionHandler) Get() {
+	if v := this.Context.GetQueryVar("set"); v != "" {
+		this.Session.Set("v", v)
+	}
+	if this.Context.GetQueryVar("login") != "" {
+		this.Session.Regenerate()
+	}
+	this.Context.WriteString(this.Session.Id() + "," + this.Session.Get("v"))
+}
+
+func TestMemorySessionStorage(t *testing.T) {
+	storage := new(wtkDefaultSessionStorage)
+	storage.Init(60)
+	defer storage.Close()
+
+	data := map[string]string{"k": "v"}
+	storage.Set("a", data)
+	data["k"] = "changed"
+	got := storage.Get("a")
+	if got["k"] != "v" {
+		t.Fatalf("want stored copy 'v', but got '%s'", got["k"])
+	}
+	got["k"] = "changed"
+	if storage.Get("a")["k"] != "v" {
+		t.Fatal("want Get to return a copy")
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			sid := "s" + strconv.Itoa(i)
+			for j := 0; j < 100; j++ {
+				storage.Set(sid, map[string]string{"j": strconv.Itoa(j)})
+				storage.Get(sid)
+				storage.Exists("a")
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+
+	storage.maxLifetime = 1
+	shard := storage.shard("a")
+	shard.lock.Lock()
+	shard.datas["a"].created -= 2
+	shard.lock.Unlock()
+	if storage.Exists("a") {
+		t.Fatal("want session past its absolute lifetime to expire")
+	}
+	storage.maxLifetime = 0
+
+	// Caps below and not a multiple of the shard count.
+	for _, max := range []int{10, sessionStorageShards + 5} {
+		limited := new(wtkDefaultSessionStorage)
+		limited.Init(60)
+		limited.maxCount = max
+		for i := 0; i < max; i++ {
+			limited.Set(strconv.Itoa(i), map[string]string{})
+		}
+		for i := 0; i < max; i++ {
+			if !limited.Exists(strconv.Itoa(i)) {
+				t.Fatalf("cap %d: want session %d kept below the cap", max, i)
+			}
+		}
+		// A session in use is not evicted.
+		limited.Get("0")
+		for i := max; i < 1000; i++ {
+			limited.Set(strconv.Itoa(i), map[string]string{})
+			limited.Get("0")
+		}
+		count := 0
+		for _, shard := range limited.shards {
+			count += len(shard.datas)
+		}
+		if count != max || limited.count != int64(max) || !limited.Exists("999") || !limited.Exists("0") {
+			t.Fatalf("cap %d: want %d sessions with the newest kept, but got %d", max, max, count)
+		}
+		limited.Close()
+	}
+}
+
+func TestFileSessionStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wtk-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := NewFileSessionStorage(dir)
+	storage.Init(60)
+	defer storage.Close()
+
+	sid := storage.CreateSessionID()
+	if storage.Exists(sid) {
+		t.Fatal("want new session id not to exist")
+	}
+	storage.Set(sid, map[string]string{"k": "v"})
+	if !storage.Exists(sid) || storage.Get(sid)["k"] != "v" {
+		t.Fatal("want stored session to be read back")
+	}
+	if _, err := os.Stat(filepath.Join(dir, sid[:2], sid)); err != nil {
+		t.Fatalf("want session file in shard directory, but got %v", err)
+	}
+
+	restarted := NewFileSessionStorage(dir)
+	restarted.Init(60)
+	defer restarted.Close()
+	if restarted.Get(sid)["k"] != "v" {
+		t.Fatal("want session to survive a restart")
+	}
+
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(filepath.Join(dir, sid[:2], sid), old, old)
+	if storage.Exists(sid) {
+		t.Fatal("want idle session to expire")
+	}
+	storage.cleanup()
+	if _, err := os.Stat(filepath.Join(dir, sid[:2], sid)); !os.IsNotExist(err) {
+		t.Fatal("want expired session file to be removed")
+	}
+
+	if storage.Exists("../../etc") {
+		t.Fatal("want invalid session id to be rejected")
+	}
+}
+
+// fakeSQLDriver understands just the statements SQLSessionStorage sends
+// with the generic dialect.
+type fakeSQLDriver struct {
+	lock       sync.Mutex
+	rows       map[string][]driver.Value
+	failCreate bool
+}
+
+type fakeSQLConn struct {
+	driver *fakeSQLDriver
+}
+
+type fakeSQLStmt struct {
+	driver *fakeSQLDriver
+	query  string
+}
+
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (this *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return &fakeSQLConn{driver: this}, nil
+}
+
+func (this *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{driver: this.driver, query: strings.Join(strings.Fields(query), " ")}, nil
+}
+
+func (this *fakeSQLConn) Close() error { return nil }
+
+func (this *fakeSQLConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (this *fakeSQLStmt) Close() error { return nil }
+
+func (this *fakeSQLStmt) NumInput() int { return -1 }
+
+func (this *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	d := this.driver
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	q := this.query
+	switch {
+	case strings.HasPrefix(q, "CREATE"):
+		if d.failCreate {
+			return nil, errors.New("database is down")
+		}
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(q, "INSERT INTO"):
+		id := args[0].(string)
+		if _, ok := d.rows[id]; ok {
+			return nil, errors.New("duplicate key")
+		}
+		d.rows[id] = []driver.Value{args[1], args[2], args[3], args[4]}
+		return driver.RowsAffected(1), nil
+	case strings.Contains(q, "SET data = ?, expires = ?, user_id = ?"):
+		row, ok := d.rows[args[3].(string)]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		row[0], row[2], row[3] = args[0], args[1], args[2]
+		return driver.RowsAffected(1), nil
+	case strings.Contains(q, "SET expires = ?"):
+		row, ok := d.rows[args[1].(string)]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		row[2] = args[0]
+		return driver.RowsAffected(1), nil
+	case strings.HasSuffix(q, "WHERE id = ?"):
+		delete(d.rows, args[0].(string))
+		return driver.RowsAffected(1), nil
+	case strings.HasSuffix(q, "WHERE expires <= ?"):
+		n := int64(0)
+		for id, row := range d.rows {
+			if row[2].(int64) <= args[0].(int64) {
+				delete(d.rows, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	return nil, errors.New("unexpected statement: " + q)
+}
+
+func (this *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := this.driver
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if strings.Contains(this.query, "WHERE user_id = ?") {
+		rows := &fakeSQLRows{columns: []string{"id", "data", "created", "expires"}}
+		for id, row := range d.rows {
+			if row[3] == args[0] && row[2].(int64) > args[1].(int64) {
+				rows.rows = append(rows.rows, []driver.Value{id, row[0], row[1], row[2]})
+			}
+		}
+		return rows, nil
+	}
+	rows := &fakeSQLRows{columns: []string{"data", "created", "expires"}}
+	if row, ok := d.rows[args[0].(string)]; ok {
+		rows.rows = append(rows.rows, append([]driver.Value{}, row...))
+	}
+	return rows, nil
+}
+
+func (this *fakeSQLRows) Columns() []string { return this.columns }
+
+func (this *fakeSQLRows) Close() error { return nil }
+
+func (this *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(this.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, this.rows[0])
+	this.rows = this.rows[1:]
+	return nil
+}
+
+func TestSQLSessionStorage(t *testing.T) {
+	fake := &fakeSQLDriver{rows: make(map[string][]driver.Value)}
+	sql.Register("wtkfake", fake)
+	db, err := sql.Open("wtkfake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage := NewSQLSessionStorage(db, SQLDialectGeneric, "sessions")
+	storage.Init(60)
+	defer storage.Close()
+
+	sid := storage.CreateSessionID()
+	if storage.Exists(sid) {
+		t.Fatal("want new session id not to exist")
+	}
+	storage.Set(sid, map[string]string{"k": "v"})
+	storage.Set(sid, map[string]string{"k": "v2"})
+	if !storage.Exists(sid) || storage.Get(sid)["k"] != "v2" {
+		t.Fatal("want stored session to be read back")
+	}
+	if len(fake.rows) != 1 {
+		t.Fatalf("want 1 row, but got %d", len(fake.rows))
+	}
+
+	storage.Set(sid, map[string]string{sessionUserKey: "alice"})
+	if infos, err := storage.UserSessions(context.Background(), "alice"); err != nil || len(infos) != 1 || infos[0].Id != sid {
+		t.Fatalf("want the session of the user, but got %v %v", infos, err)
+	}
+
+	fake.rows[sid][2] = time.Now().Unix() - 1
+	if storage.Exists(sid) {
+		t.Fatal("want expired session not to exist")
+	}
+	storage.Cleanup()
+	if len(fake.rows) != 0 {
+		t.Fatal("want expired row to be deleted")
+	}
+
+	fake.failCreate = true
+	failed := NewSQLSessionStorage(db, SQLDialectGeneric, "sessions2")
+	failed.Init(60)
+	defer failed.Close()
+	if _, err := failed.Load(context.Background(), sid); err == nil || err == ErrSessionNotFound {
+		t.Fatalf("want the error of the missing table, but got %v", err)
+	}
+	if err := failed.Cleanup(); err == nil {
+		t.Fatal("want cleanup to report the missing table")
+	}
+	fake.failCreate = false
+	if _, err := failed.Load(context.Background(), sid); err != ErrSessionNotFound {
+		t.Fatalf("want the table to be created on the next call, but got %v", err)
+	}
+}
+
+func TestCookieSessionStorage(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.RegisterSessionStorage(NewCookieSessionStorage(3))
+	s.AddRoute("/session", &SessionHandler{})
+
+	code := 0
+	get := func(path string, cookies map[string]string) (string, map[string]string) {
+		r, _ := http.NewRequest("GET", path, nil)
+		for k, v := range cookies {
+			r.AddCookie(&http.Cookie{Name: k, Value: v})
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		code = w.Code
+		return w.Body.String(), readSetCookies(w.Header())
+	}
+
+	body, cookies := get("/session?set=foo", nil)
+	sid := strings.SplitN(body, ",", 2)[0]
+	body, _ = get("/session", cookies)
+	if body != sid+",foo" {
+		t.Fatalf("want '%s,foo', but got '%s'", sid, body)
+	}
+
+	big := strings.Repeat("x", 5000)
+	body, cookies = get("/session?set="+big, cookies)
+	if _, ok := cookies[SessionName+"_1"]; !ok {
+		t.Fatal("want large session to be split over several cookies")
+	}
+	body, _ = get("/session", cookies)
+	if body != sid+","+big {
+		t.Fatal("want large session to be read back from the chunks")
+	}
+
+	huge := "/session?set=" + strings.Repeat("x", 20000)
+	get(huge, cookies)
+	body, _ = get("/session", cookies)
+	if body != sid+","+big {
+		t.Fatal("want session over the size limit not to be saved")
+	}
+
+	defer func(policy string) { SessionFailurePolicy = policy }(SessionFailurePolicy)
+	SessionFailurePolicy = SessionFailClosed
+	body, cookies = get(huge, cookies)
+	if code != http.StatusServiceUnavailable || len(cookies) != 0 {
+		t.Fatalf("want 503 for a session over the size limit, but got %d '%s'", code, body)
+	}
+}
+
+type failingSessionStore struct{}
+
+var errStoreDown = errors.New("store down")
+
+func (this failingSessionStore) Load(ctx context.Context, sid string) (map[string]string, error) {
+	return nil, errStoreDown
+}
+
+func (this failingSessionStore) Save(ctx context.Context, sid string, data map[string]string) error {
+	return errStoreDown
+}
+
+func (this failingSessionStore) Destroy(ctx context.Context, sid string) error {
+	return errStoreDown
+}
+
+func (this failingSessionStore) Touch(ctx context.Context, sid string) error {
+	return errStoreDown
+}
+
+func (this failingSessionStore) Close() error {
+	return nil
+}
+
+// flakySessionStore cannot load sessions but saves and destroys them.
+type flakySessionStore struct {
+	failingSessionStore
+	saved     []string
+	destroyed []string
+}
+
+func (this *flakySessionStore) Save(ctx context.Context, sid string, data map[string]string) error {
+	this.saved = append(this.saved, sid)
+	return nil
+}
+
+func (this *flakySessionStore) Destroy(ctx context.Context, sid string) error {
+	this.destroyed = append(this.destroyed, sid)
+	return nil
+}
+
+func TestSessionStoreFailure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.RegisterSessionStore(failingSessionStore{})
+	s.AddRoute("/session", &SessionHandler{})
+	defer func(policy string) { SessionFailurePolicy = policy }(SessionFailurePolicy)
+
+	r, _ := http.NewRequest("GET", "/session?set=foo", nil)
+	ctx := &Context{Request: r}
+	r.AddCookie(&http.Cookie{Name: SessionName, Value: ctx.encodeSecureCookie(SessionName, "existing", 0)})
+
+	SessionFailurePolicy = SessionFailOpen
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "existing,foo" {
+		t.Fatalf("want fail open to serve the request, but got %d '%s'", w.Code, w.Body.String())
+	}
+
+	SessionFailurePolicy = SessionFailClosed
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("want fail closed to answer 503, but got %d", w.Code)
+	}
+
+	// A login while the store cannot load the session keeps it.
+	flaky := &flakySessionStore{}
+	s.RegisterSessionStore(flaky)
+	SessionFailurePolicy = SessionFailOpen
+	r, _ = http.NewRequest("GET", "/session?login=1", nil)
+	r.AddCookie(&http.Cookie{Name: SessionName, Value: ctx.encodeSecureCookie(SessionName, "existing", 0)})
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	if w.Body.String() != "existing," || len(flaky.saved) != 0 || len(flaky.destroyed) != 0 {
+		t.Fatalf("want the session kept, but got '%s' saved %v destroyed %v", w.Body.String(), flaky.saved, flaky.destroyed)
+	}
+
+	file := NewFileSessionStorage(t.TempDir())
+	file.Init(60)
+	defer file.Close()
+	if _, err := file.Load(context.Background(), "unknownsession"); err != ErrSessionNotFound {
+		t.Fatalf("want ErrSessionNotFound, but got %v", err)
+	}
+}
+
+func TestSessionValues(t *testing.T) {
+	w := request("GET", "/session/values?step=1", nil, nil)
+	cookies := readSetCookies(w.Header())
+	if body := w.Body.String(); body != "42,true,[a b],true" {
+		t.Fatalf("want '42,true,[a b],true', but got '%s'", body)
+	}
+	if len(w.Header()["Set-Cookie"]) != 1 {
+		t.Fatalf("want the session cookie once, but got %v", w.Header()["Set-Cookie"])
+	}
+
+	w = request("GET", "/session/values?step=2", nil, cookies)
+	if body := w.Body.String(); body != "<p>saved</p>" {
+		t.Fatalf("want flash message in template, but got '%s'", body)
+	}
+	w = request("GET", "/session/values?step=2", nil, cookies)
+	if body := w.Body.String(); body != "" {
+		t.Fatalf("want flash message to be read once, but got '%s'", body)
+	}
+
+	w = request("GET", "/session/values?step=3", nil, cookies)
+	if !strings.Contains(w.Header().Get("Set-Cookie"), "Max-Age=0") {
+		t.Fatal("want destroyed session cookie to expire")
+	}
+	w = request("GET", "/session/values?step=4", nil, cookies)
+	if body := w.Body.String(); body != "false" {
+		t.Fatalf("want destroyed session to be empty, but got '%s'", body)
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	// The session cookie is bound to the user agent.
+	get := func(path string, ua string, cookies map[string]string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.Header.Set("User-Agent", ua)
+		for k, v := range cookies {
+			r.AddCookie(&http.Cookie{Name: k, Value: v})
+		}
+		w := httptest.NewRecorder()
+		testServer.router.ServeHTTP(w, r)
+		return w
+	}
+	phone := readSetCookies(get("/session/user?login=alice", "phone", nil).Header())
+	get("/session/user?login=alice", "laptop", nil)
+
+	infos, err := testServer.UserSessions("alice")
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("want 2 sessions, but got %v %v", infos, err)
+	}
+	if infos[0].UserId != "alice" || infos[0].UserAgent == "" || infos[0].Created.IsZero() {
+		t.Fatalf("want session metadata, but got %+v", infos[0])
+	}
+
+	w := get("/session/user?clear=1", "phone", phone)
+	if body := w.Body.String(); body != "k||alice" {
+		t.Fatalf("want the user binding kept out of the values, but got '%s'", body)
+	}
+	if infos, _ := testServer.UserSessions("alice"); len(infos) != 2 {
+		t.Fatalf("want the cleared session still listed, but got %+v", infos)
+	}
+
+	w = get("/session/user?revoke=others", "phone", phone)
+	if body := w.Body.String(); body != "1" {
+		t.Fatalf("want 1 session left, but got '%s'", body)
+	}
+	infos, _ = testServer.UserSessions("alice")
+	if len(infos) != 1 || infos[0].UserAgent != "phone" {
+		t.Fatalf("want only the phone session left, but got %+v", infos)
+	}
+
+	if err := testServer.RevokeUserSessions("alice"); err != nil {
+		t.Fatal(err)
+	}
+	w = get("/session/user", "phone", phone)
+	if body := w.Body.String(); body != "" {
+		t.Fatalf("want revoked session to be logged out, but got '%s'", body)
+	}
+}
+
+type SessionUserHandler struct {
+	Handler
+}
+
+func (this *SessionUserHandler) Get() {
+	if user := this.Context.GetQueryVar("login"); user != "" {
+		this.Session.Regenerate()
+		this.Session.SetUser(user)
+	}
+	if this.Context.GetQueryVar("clear") != "" {
+		this.Session.Set("k", "v")
+		this.Session.Set(sessionUserKey, "mallory")
+		this.Session.Delete(sessionIPKey)
+		keys := strings.Join(this.Session.Keys(), ",")
+		this.Session.Clear()
+		this.Context.WriteString(keys + "|" + strings.Join(this.Session.Keys(), ",") + "|" + this.Session.UserId())
+		return
+	}
+	if this.Context.GetQueryVar("revoke") == "others" {
+		this.Session.RevokeOtherSessions()
+		infos, _ := this.Session.UserSessions()
+		this.Context.WriteString(strconv.Itoa(len(infos)))
+		return
+	}
+	this.Context.WriteString(this.Session.UserId())
+}
+
+func TestCsrf(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddRoute("/form", &CsrfHandler{})
+	s.AddRoute("/hook", &CsrfHandler{}).Csrf(false)
+	s.AddHttpStatusHook(403, func(h *HookHandler) {
+		h.Context.WriteString("custom 403")
+	})
+	defer func(enable bool, mode string) { EnableCsrf, CsrfMode = enable, mode }(EnableCsrf, CsrfMode)
+	EnableCsrf = true
+
+	tokenRe := regexp.MustCompile(`name="_csrf" value="([^"]+)"`)
+	serve := func(method, path string, form url.Values, header map[string]string, cookies map[string]string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		for k, v := range cookies {
+			r.AddCookie(&http.Cookie{Name: k, Value: v})
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, mode := range []string{CsrfModeSession, CsrfModeCookie} {
+		CsrfMode = mode
+		w := serve("GET", "/form", nil, nil, nil)
+		m := tokenRe.FindStringSubmatch(w.Body.String())
+		if m == nil {
+			t.Fatalf("%s: want a hidden token field, but got '%s'", mode, w.Body.String())
+		}
+		cookies := readSetCookies(w.Header())
+
+		w = serve("POST", "/form", url.Values{}, nil, cookies)
+		if w.Code != 403 || w.Body.String() != "custom 403" {
+			t.Fatalf("%s: want post without token to be rejected, but got %d '%s'", mode, w.Code, w.Body.String())
+		}
+		w = serve("POST", "/form", url.Values{"_csrf": {m[1]}}, nil, cookies)
+		if w.Body.String() != "ok" {
+			t.Fatalf("%s: want post with token field to pass, but got %d '%s'", mode, w.Code, w.Body.String())
+		}
+		w = serve("POST", "/form", nil, map[string]string{"X-CSRF-Token": m[1]}, cookies)
+		if w.Body.String() != "ok" {
+			t.Fatalf("%s: want post with token header to pass, but got %d '%s'", mode, w.Code, w.Body.String())
+		}
+		w = serve("POST", "/form", nil, map[string]string{"X-CSRF-Token": m[1], "Origin": "http://evil.example"}, cookies)
+		if w.Code != 403 {
+			t.Fatalf("%s: want post from another origin to be rejected, but got %d", mode, w.Code)
+		}
+	}
+
+	if w := serve("POST", "/hook", url.Values{}, nil, nil); w.Body.String() != "ok" {
+		t.Fatalf("want route opt-out to accept the post, but got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+type CsrfHandler struct {
+	Handler
+}
+
+func (this *CsrfHandler) Get() {
+	this.Template.SetTemplateString(`<form method="post">{{csrf_field}}</form>`)
+}
+
+func (this *CsrfHandler) Post() {
+	this.Context.WriteString("ok")
+}
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"layouts/base.html": `<title>{{block "title" .}}Site{{end}}</title>{{template "partials/nav.html" .}}{{block "content" .}}{{end}}`,
+		"partials/nav.html": `<nav>{{.User}}</nav>`,
+		"index.html":        "{{extends \"layouts/base.html\"}}\n{{define \"content\"}}<p>index</p>{{end}}",
+		"about.html":        "{{extends \"layouts/base.html\"}}\n{{define \"title\"}}About{{end}}",
+		"broken.html":       `{{if}}`,
+		"partials/a.html":   `{{define "icon"}}a{{end}}`,
+		"partials/b.html":   `{{define "icon"}}b{{end}}`,
+		"icon.html":         `{{template "icon"}}`,
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	}
+
+	s := NewServer()
+	defer s.Close()
+	if err := s.LoadTemplates(dir); err == nil || !strings.Contains(err.Error(), "broken.html") {
+		t.Fatalf("want the parse error of broken.html, but got %v", err)
+	}
+	s.AddRoute("/{name(.*)}", &TemplateHandler{})
+	render := func(name string) string {
+		r, _ := http.NewRequest("GET", "/"+name, nil)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if body := render("index.html"); body != "<title>Site</title><nav>bob</nav><p>index</p>" {
+		t.Fatalf("want index in layout, but got '%s'", body)
+	}
+	if body := render("about.html"); body != "<title>About</title><nav>bob</nav>" {
+		t.Fatalf("want about in layout, but got '%s'", body)
+	}
+	if body := render("broken.html"); !strings.HasPrefix(body, "error: ") {
+		t.Fatalf("want the template error, but got '%s'", body)
+	}
+	for i := 0; i < 10; i++ {
+		s.LoadTemplates(dir)
+		if body := render("icon.html"); body != "b" {
+			t.Fatalf("want the define of the last partial, but got '%s'", body)
+		}
+	}
+
+	defer func(env string) { AppEnv = env }(AppEnv)
+	AppEnv = EnvDevelopment
+	nav := filepath.Join(dir, "partials/nav.html")
+	ioutil.WriteFile(nav, []byte(`<nav>{{.User}}!</nav>`), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(nav, later, later)
+	s.templates.checked = time.Time{}
+	if body := render("index.html"); body != "<title>Site</title><nav>bob!</nav><p>index</p>" {
+		t.Fatalf("want changed partial to be reloaded, but got '%s'", body)
+	}
+}
+
+func TestTemplateError(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddRoute("/broken", &BrokenTemplateHandler{})
+	render := func() *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/broken", nil)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+	defer func(env string) { AppEnv = env }(AppEnv)
+
+	w := render()
+	if w.Code != 500 || w.Body.String() != "Internal Server Error" {
+		t.Fatalf("want no error details by default, but got %d '%s'", w.Code, w.Body.String())
+	}
+
+	AppEnv = EnvDevelopment
+	w = render()
+	if w.Code != 500 || !strings.Contains(w.Body.String(), "<code>{{.User.Missing}}</code>") ||
+		!strings.Contains(w.Body.String(), "&lt;p&gt;{{.User.Missing}}&lt;/p&gt;") {
+		t.Fatalf("want the development error page, but got %d '%s'", w.Code, w.Body.String())
+	}
+
+	AppEnv = EnvProduction
+	var te *TemplateError
+	s.AddHttpStatusHook(500, func(h *HookHandler) {
+		te, _ = h.Context.Err().(*TemplateError)
+		h.Context.WriteString("custom 500")
+	})
+	w = render()
+	if w.Code != 500 || w.Body.String() != "custom 500" {
+		t.Fatalf("want the 500 hook, but got %d '%s'", w.Code, w.Body.String())
+	}
+	if te == nil || te.Line != 2 || te.Action != "{{.User.Missing}}" {
+		t.Fatalf("want the template error in the hook, but got %+v", te)
+	}
+}
+
+type BrokenTemplateHandler struct {
+	Handler
+}
+
+func (this *BrokenTemplateHandler) Get() {
+	this.Template.SetTemplateString("<h1>title</h1>\n<p>{{.User.Missing}}</p>")
+	this.Template.SetVar("User", "bob")
+}
+
+func TestTemplateEngines(t *testing.T) {
+	AddTemplateFunc("shout", strings.ToUpper)
+	AddTemplateFunc("site", func() string { return "wtk" })
+	s := NewServer()
+	defer s.Close()
+	s.AddRoute("/engine/{name}", &EngineHandler{})
+	dir := t.TempDir()
+	files := map[string]string{
+		"mail.txt":      `Hi {{.User}} & {{shout "bye"}}`,
+		"list.mustache": "{{#Items}}\n<li>{{.}}</li>\n{{/Items}}\n{{^Empty}}none{{/Empty}} {{site}} {{{Raw}}}",
+		"page.md":       "# {{.User}}\n\nSome *emphasis*, `code` and a [link](http://example.com).\n\n- one\n- two\n\n<b>raw</b> [bad](javascript:alert)",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	}
+	render := func(name string) string {
+		r, _ := http.NewRequest("GET", "/engine/"+name+"?dir="+url.QueryEscape(dir), nil)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if body := render("mail.txt"); body != "Hi <bob> & BYE" {
+		t.Fatalf("want unescaped text template, but got '%s'", body)
+	}
+	if body := render("list.mustache"); body != "<li>a</li>\n<li>&lt;b&gt;</li>\nnone wtk <i>x</i>" {
+		t.Fatalf("want mustache output, but got '%s'", body)
+	}
+	want := "<h1>&lt;bob&gt;</h1>\n" +
+		`<p>Some <em>emphasis</em>, <code>code</code> and a <a href="http://example.com">link</a>.</p>` + "\n" +
+		"<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n" +
+		`<p>&lt;b&gt;raw&lt;/b&gt; <a href="#">bad</a></p>` + "\n"
+	if body := render("page.md"); body != want {
+		t.Fatalf("want markdown output\n%s\nbut got\n%s", want, body)
+	}
+	if body := render("string"); body != "<p>&lt;bob&gt;</p>\n" {
+		t.Fatalf("want markdown engine set on the handler, but got '%s'", body)
+	}
+
+	engine := FuncTemplateEngine(TextTemplateEngine{}.Parse)
+	for i := 0; i < 2; i++ {
+		if _, err := s.templates.File(filepath.Join(dir, "mail.txt"), engine); err != nil {
+			t.Fatalf("want a file compiled by an engine func, but got %v", err)
+		}
+	}
+}
+
+type FuncTemplateEngine func(name string, text string, funcs map[string]interface{}) (TemplateExecutor, error)
+
+func (this FuncTemplateEngine) Parse(name string, text string, funcs map[string]interface{}) (TemplateExecutor, error) {
+	return this(name, text, funcs)
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	defer func(root string) { AppRoot = root }(AppRoot)
+	AppRoot = t.TempDir()
+	os.MkdirAll(filepath.Join(AppRoot, "css"), 0700)
+	ioutil.WriteFile(filepath.Join(AppRoot, "css/app.css"), []byte("body{}"), 0600)
+
+	s := NewServer()
+	defer s.Close()
+	s.AddRoute("/post/{id}-{page([0-9]+)}", &IndexHandler{}).Name("post")
+	s.AddRoute("/funcs", &FuncsHandler{})
+	if u, err := s.URLFor("post", "id", "a b", "page", 2, "ref", "x"); err != nil || u != "/post/a%20b-2?ref=x" {
+		t.Fatalf("want route url, but got '%s' %v", u, err)
+	}
+	if _, err := s.URLFor("post", "id", "a", "page", "x"); err == nil {
+		t.Fatal("want an error for a value not matching the route")
+	}
+
+	r, _ := http.NewRequest("GET", "/funcs", nil)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	want := `/post/7-1 /css/app.css?v=` + fmt.Sprintf("%x", sha1.Sum([]byte("body{}")))[:8] +
+		` 2024-03-01 -1,234,567.50 Hello… 1 item 3 items n/a b <script>var d = {"k":[1,"x"]};</script>`
+	if body := w.Body.String(); body != want {
+		t.Fatalf("want\n%s\nbut got\n%s", want, body)
+	}
+}
+
+func TestServerTemplateConfig(t *testing.T) {
+	SetTemplateVar("Lang", "en")
+	public, admin := NewServer(), NewServer()
+	defer public.Close()
+	defer admin.Close()
+	public.AddTemplateFunc("brand", func() string { return "public" })
+	public.SetTemplateVar("Title", "Shop")
+	admin.AddTemplateFunc("brand", func() string { return "admin" })
+	admin.SetTemplateVar("Title", "Admin")
+	admin.SetTemplateDelims("[[", "]]")
+
+	dirs := map[*Server]map[string]string{
+		public: {"page.html": `{{brand}} {{.Title}} {{.Lang}} {{.User}}`},
+		admin: {
+			"base.html": `<b>[[block "content" .]][[end]]</b>`,
+			"page.html": "[[extends \"base.html\"]]\n[[define \"content\"]]{{[[brand]] [[.Title]] [[.Lang]] [[.User]]}}[[end]]",
+		},
+	}
+	for s, files := range dirs {
+		dir := t.TempDir()
+		for name, content := range files {
+			ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		}
+		s.SetTemplateDir(dir)
+		if err := s.LoadTemplates(""); err != nil {
+			t.Fatal(err)
+		}
+		s.AddRoute("/{name(.*)}", &TemplateHandler{})
+	}
+	render := func(s *Server) string {
+		r, _ := http.NewRequest("GET", "/page.html", nil)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	if body := render(public); body != "public Shop en bob" {
+		t.Fatalf("want public config, but got '%s'", body)
+	}
+	if body := render(admin); body != "<b>{{admin Admin en bob}}</b>" {
+		t.Fatalf("want admin config, but got '%s'", body)
+	}
+}
+
+func TestTemplateFragments(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "base.html"), []byte(`<html>{{block "content" .}}{{end}}</html>`), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "list.html"), []byte("{{extends \"base.html\"}}\n{{define \"content\"}}<ul>{{.User}}</ul>{{end}}"), 0600)
+	s := NewServer()
+	defer s.Close()
+	if err := s.LoadTemplates(dir); err != nil {
+		t.Fatal(err)
+	}
+	s.AddRoute("/fragment/{name}", &FragmentHandler{})
+	render := func(path string, fragment bool) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		if fragment {
+			r.Header.Set("HX-Request", "true")
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := render("/fragment/list.html", false); w.Body.String() != "<html><ul>bob</ul></html>" || w.Header().Get("Vary") != "HX-Request" {
+		t.Fatalf("want the whole page, but got '%s' %v", w.Body.String(), w.Header())
+	}
+	if w := render("/fragment/list.html", true); w.Body.String() != "<ul>bob</ul>" {
+		t.Fatalf("want the content block, but got '%s'", w.Body.String())
+	}
+	if w := render("/fragment/row", false); w.Body.String() != "<li>bob</li>" {
+		t.Fatalf("want the sub template, but got '%s'", w.Body.String())
+	}
+	if w := render("/fragment/missing", false); w.Code != 500 {
+		t.Fatalf("want 500 for a missing block, but got %d '%s'", w.Code, w.Body.String())
+	}
+
+	// The cache keeps the page and the fragment apart by the Vary header.
+	s.AddRoute("/cached/fragment/{name}", &FragmentHandler{}).Cache(&ResponseCacheRule{})
+	for i := 0; i < 2; i++ {
+		if w := render("/cached/fragment/list.html", true); w.Body.String() != "<ul>bob</ul>" {
+			t.Fatalf("want the cached content block, but got '%s'", w.Body.String())
+		}
+		w := render("/cached/fragment/list.html", false)
+		if w.Body.String() != "<html><ul>bob</ul></html>" {
+			t.Fatalf("want the cached whole page, but got '%s'", w.Body.String())
+		}
+		if i == 1 && w.Header().Get("Age") == "" {
+			t.Fatal("want the whole page from the cache")
+		}
+	}
+}
+
+type FragmentHandler struct {
+	Handler
+}
+
+func (this *FragmentHandler) Get() {
+	this.Template.SetVar("User", "bob")
+	switch name := this.Context.GetPathVar("name"); name {
+	case "list.html":
+		this.Template.SetTemplateName(name)
+		this.Template.SetFragment("content")
+	default:
+		this.Template.SetTemplateString(`<ul>{{template "row" .}}</ul>`)
+		this.Template.SetSubTemplateString("row", `<li>{{.User}}</li>`)
+		this.Template.RenderBlock(name)
+	}
+}
+
+func TestI18n(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"en.json": `{"hello": "Hello {name}", "nav": {"home": "Home", "about": "About"},
+			"items": {"one": "{count} item", "other": "{count} items"}}`,
+		"fr.toml": "# French\nhello = \"Bonjour {name}\"\n\n[nav]\nhome = 'Accueil'\n\n" +
+			"[items]\none = \"{count} article\"\nother = \"\"\"{count}\narticles\"\"\"\n",
+		"pt-BR.json": `{"hello": "Olá {name}"}`,
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	}
+	s := NewServer()
+	defer s.Close()
+	if err := s.LoadLocales(dir); err != nil {
+		t.Fatal(err)
+	}
+	s.AddRoute("/i18n", &I18nHandler{})
+	defer func(v bool) { EnableLocalePath = v }(EnableLocalePath)
+	EnableLocalePath = true
+	var vary string
+	render := func(path string, lang string, cookie string) string {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Language", lang)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "lang", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		vary = strings.Join(w.Header()["Vary"], ", ")
+		return w.Body.String()
+	}
+
+	tests := []struct{ path, lang, cookie, want, vary string }{
+		{"/i18n", "", "", "en|Hello bob|Home|0 items|1 item|About", "Cookie, Accept-Language"},
+		{"/i18n", "de, fr;q=0.8, en;q=0.5", "", "fr|Bonjour bob|Accueil|0 article|2\narticles|About", "Cookie, Accept-Language"},
+		{"/i18n", "fr", "pt_br", "pt-BR|Olá bob|Home|0 items|1 item|About", "Cookie"},
+		{"/i18n?lang=en", "fr", "pt-BR", "en|Hello bob|Home|0 items|1 item|About", ""},
+		{"/fr/i18n", "en", "", "fr|Bonjour bob|Accueil|0 article|2\narticles|About", ""},
+	}
+	for _, test := range tests {
+		if body := render(test.path, test.lang, test.cookie); body != test.want || vary != test.vary {
+			t.Fatalf("%s %s %s: want '%s' with Vary '%s', but got '%s' with '%s'", test.path, test.lang, test.cookie, test.want, test.vary, body, vary)
+		}
+	}
+
+	missing := s.MissingTranslations()
+	if fmt.Sprint(missing) != "map[fr:[nav.about] pt-BR:[items nav.about nav.home]]" {
+		t.Fatalf("want missing keys, but got %v", missing)
+	}
+
+	defer func(env string) { AppEnv = env }(AppEnv)
+	AppEnv = EnvDevelopment
+	en := filepath.Join(dir, "en.json")
+	ioutil.WriteFile(en, []byte(`{"hello": "Hi {name}"}`), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(en, later, later)
+	s.i18n.checked = time.Time{}
+	if body := render("/i18n", "", ""); body != "en|Hi bob|nav.home|items|items|nav.about" {
+		t.Fatalf("want the changed catalog to be reloaded, but got '%s'", body)
+	}
+}
+
+type I18nHandler struct {
+	Handler
+}
+
+func (this *I18nHandler) Get() {
+	n := 2
+	if this.Context.Locale() != "fr" {
+		n = 1
+	}
+	this.Template.SetTemplateString(`{{locale}}|{{T "hello" "name" "bob"}}|{{T "nav.home"}}|{{T "items" "count" 0}}|` +
+		`{{T "items" "count" .N}}|{{.About}}`)
+	this.Template.SetVar("N", n)
+	this.Template.SetVar("About", this.Context.T("nav.about"))
+}
+
+func TestOutputFilters(t *testing.T) {
+	defer func(root string) { AppRoot = root }(AppRoot)
+	AppRoot = t.TempDir()
+	os.MkdirAll(filepath.Join(AppRoot, "css"), 0700)
+	ioutil.WriteFile(filepath.Join(AppRoot, "css/app.css"), []byte("b{}"), 0600)
+	ioutil.WriteFile(filepath.Join(AppRoot, "app.js"), []byte("go()"), 0600)
+	version := fmt.Sprintf("%x", sha1.Sum([]byte("go()")))[:8]
+
+	s := NewServer()
+	defer s.Close()
+	s.AddOutputFilter("minify", MinifyHTML)
+	s.AddOutputFilter("inline", InlineAssets)
+	s.AddOutputFilter("fingerprint", FingerprintAssets)
+	s.AddOutputFilter("mark", func(ctx *Context, content []byte) ([]byte, error) {
+		return append(content, "<!--done-->"...), nil
+	}, "text/*")
+	s.AddRoute("/page", &OutputFilterHandler{})
+	s.AddRoute("/minify", &OutputFilterHandler{}).OutputFilters("minify")
+	s.AddRoute("/off", &OutputFilterHandler{}).OutputFilters()
+	s.AddRoute("/text", &OutputFilterHandler{})
+	render := func(path string) string {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	want := `<html><head><style>b{}</style><script src="/app.js?v=` + version + `"></script></head>` +
+		"<body><p>Hello <b>bob</b> !</p><pre> keep\n  this </pre></body></html><!--done-->"
+	if body := render("/page"); body != want {
+		t.Fatalf("want\n%s\nbut got\n%s", want, body)
+	}
+	want = `<html><head><link rel="stylesheet" href="/css/app.css" data-inline><script src="/app.js"></script></head>` +
+		"<body><p>Hello <b>bob</b> !</p><pre> keep\n  this </pre></body></html>"
+	if body := render("/minify"); body != want {
+		t.Fatalf("want only minify\n%s\nbut got\n%s", want, body)
+	}
+	if body := render("/off"); !strings.Contains(body, "<p>Hello   <b>") || strings.Contains(body, "done") {
+		t.Fatalf("want no filters, but got '%s'", body)
+	}
+	if body := render("/text"); body != "Hello  bob\n<!--done-->" {
+		t.Fatalf("want only the text filter, but got '%s'", body)
+	}
+}
+
+type OutputFilterHandler struct {
+	Handler
+}
+
+func (this *OutputFilterHandler) Get() {
+	if this.Context.Request.URL.Path == "/text" {
+		this.Template.SetEngine(TextTemplateEngine{})
+		this.Template.SetTemplateString("Hello  {{.User}}\n")
+	} else {
+		this.Template.SetTemplateString(`<html>
+<head>
+  <link rel="stylesheet" href="/css/app.css" data-inline>
+  <script src="/app.js"></script>
+</head>
+<body>
+  <!-- comment -->
+  <p>Hello   <b>{{.User}}</b> !</p>
+  <pre> keep
+  this </pre>
+</body>
+</html>
+`)
+	}
+	this.Template.SetVar("User", "bob")
+}
+
+func TestMail(t *testing.T) {
+	defer func(root string) { AppRoot = root }(AppRoot)
+	AppRoot = t.TempDir()
+	files := map[string]string{
+		"templates/mail/welcome.html": `{{define "subject"}}{{printf "%s & %s" (T "welcome") .Site}}{{end}}` +
+			`<p>{{T "welcome"}} {{.User}}</p><img src="{{mail_inline "logo.png"}}">`,
+		"templates/mail/welcome.txt": `{{T "welcome"}} {{.User}} & {{.Site}}`,
+		"locales/fr.json":            `{"welcome": "Bienvenue"}`,
+		"logo.png":                   "png",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(AppRoot, name)), 0700)
+		ioutil.WriteFile(filepath.Join(AppRoot, name), []byte(content), 0600)
+	}
+	s := NewServer()
+	defer s.Close()
+	s.SetTemplateVar("Site", "wtk")
+	if err := s.LoadTemplates("templates"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadLocales("locales"); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s.RenderMail("mail/welcome", "fr", map[string]interface{}{"User": "<bob>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "Bienvenue & wtk" || m.Text != "Bienvenue <bob> & wtk" ||
+		m.HTML != `<p>Bienvenue &lt;bob&gt;</p><img src="cid:`+m.Inlines[0].ContentID+`">` {
+		t.Fatalf("want rendered mail, but got %q %q %q", m.Subject, m.Text, m.HTML)
+	}
+	if _, err := s.RenderMail("mail/missing", "", nil); err == nil {
+		t.Fatal("want an error for a missing template")
+	}
+
+	m.From = "Shop <shop@example.com>"
+	m.To = []string{"Bob <bob@example.com>"}
+	m.Bcc = []string{"audit@example.com"}
+	m.Attach("report.txt", "", []byte("report"))
+	mbox := filepath.Join(AppRoot, "mail.mbox")
+	s.SetMailTransport(&MboxMailTransport{Filename: mbox})
+	if err := s.SendMail(m); err != nil {
+		t.Fatal(err)
+	}
+	if rcpts, _ := m.Recipients(); fmt.Sprint(rcpts) != "[bob@example.com audit@example.com]" {
+		t.Fatalf("want recipients, but got %v", rcpts)
+	}
+
+	content, _ := ioutil.ReadFile(mbox)
+	if !bytes.HasPrefix(content, []byte("From shop@example.com ")) {
+		t.Fatalf("want an mbox from line, but got '%s'", content)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(content[bytes.IndexByte(content, '\n')+1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != `"Bob" <bob@example.com>` || msg.Header.Get("Bcc") != "" {
+		t.Fatalf("want address headers, but got %v", msg.Header)
+	}
+	// mixed: related (alternative text and html, inline logo), attachment
+	types := []string{}
+	var walk func(r io.Reader, contentType string)
+	walk = func(r io.Reader, contentType string) {
+		mediaType, params, _ := mime.ParseMediaType(contentType)
+		types = append(types, mediaType)
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return
+		}
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			walk(part, part.Header.Get("Content-Type"))
+		}
+	}
+	walk(msg.Body, msg.Header.Get("Content-Type"))
+	want := "[multipart/mixed multipart/related multipart/alternative text/plain text/html image/png text/plain]"
+	if fmt.Sprint(types) != want {
+		t.Fatalf("want parts %s, but got %v", want, types)
+	}
+
+	m.Headers["X-Campaign"] = "spring\r\nBcc: evil@example.com"
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = mail.ReadMessage(bytes.NewReader(b)); err != nil || msg.Header.Get("Bcc") != "" {
+		t.Fatalf("want the value of a header to be encoded, but got %v %v", msg.Header, err)
+	}
+	for _, name := range []string{"X-Evil\r\nBcc", "X Tag", "message-id", "From", "Content-Type"} {
+		m.Headers = map[string]string{name: "x"}
+		if _, err := m.Bytes(); err == nil {
+			t.Fatalf("want header %q to be rejected", name)
+		}
+	}
+}
+
+func TestRenderer(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.html": `<h1>{{block "title" .}}{{.Site}}{{end}}</h1>{{block "body" .}}{{end}}`,
+		"page.html": "{{extends \"base.html\"}}\n{{define \"body\"}}<p>{{.User}} {{shout \"hi\"}}</p>{{end}}",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	}
+	outside := filepath.Join(t.TempDir(), "note.txt")
+	ioutil.WriteFile(outside, []byte("note for {{.User}}"), 0600)
+
+	s := NewServer()
+	defer s.Close()
+	s.AddTemplateFunc("shout", strings.ToUpper)
+	s.SetTemplateVar("Site", "wtk")
+	if err := s.LoadTemplates(dir); err != nil {
+		t.Fatal(err)
+	}
+	r := s.NewRenderer()
+	r.SetVar("User", "<bob>")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b, err := r.RenderBytes("page.html", nil); err != nil || string(b) != "<h1>wtk</h1><p>&lt;bob&gt; HI</p>" {
+				t.Errorf("want the page, but got '%s' %v", b, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var w bytes.Buffer
+	if err := r.RenderBlock(&w, "page.html", "body", map[string]interface{}{"User": "ann"}); err != nil || w.String() != "<p>ann HI</p>" {
+		t.Fatalf("want the block, but got '%s' %v", w.String(), err)
+	}
+	if b, err := r.RenderBytes(outside, nil); err != nil || string(b) != "note for <bob>" {
+		t.Fatalf("want the text file, but got '%s' %v", b, err)
+	}
+	if b, err := r.RenderStringBytes(`{{.Site}}: {{T "x"}}`, nil); err != nil || string(b) != "wtk: x" {
+		t.Fatalf("want the string, but got '%s' %v", b, err)
+	}
+
+	w.Reset()
+	err := r.RenderString(&w, "ok\n{{.User.Missing}}", nil)
+	if te, ok := err.(*TemplateError); !ok || te.Line != 2 || w.Len() != 0 {
+		t.Fatalf("want a template error and no output, but got %v '%s'", err, w.String())
+	}
+	if _, err := r.RenderBytes("missing.html", nil); err == nil {
+		t.Fatal("want an error for a missing template")
+	}
+}
+
+type FuncsHandler struct {
+	Handler
+}
+
+func (this *FuncsHandler) Get() {
+	this.Template.SetTemplateString(`{{urlfor "post" "id" 7 "page" 1}} {{static "css/app.css"}} ` +
+		`{{.Time | date "2006-01-02"}} {{number -1234567.5 2}} {{truncate 5 "Hello world"}} ` +
+		`1 {{pluralize 1 "item" "items"}} 3 {{pluralize 3 "item" "items"}} {{.Missing | default "n/a"}} ` +
+		`{{(dict "a" "b").a}} <script>var d = {{json (dict "k" (list 1 "x"))}};</script>`)
+	this.Template.SetVar("Time", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+}
+
+type EngineHandler struct {
+	Handler
+}
+
+func (this *EngineHandler) Get() {
+	name := this.Context.GetPathVar("name")
+	if name == "string" {
+		this.Template.SetEngine(MarkdownTemplateEngine{})
+		this.Template.SetTemplateString("{{.User}}")
+	} else {
+		this.Template.SetTemplateFile(filepath.Join(this.Context.GetQueryVar("dir"), name))
+	}
+	this.Template.SetVar("User", "<bob>")
+	this.Template.SetVar("Items", []string{"a", "<b>"})
+	this.Template.SetVar("Raw", "<i>x</i>")
+}
+
+type TemplateHandler struct {
+	Handler
+}
+
+func (this *TemplateHandler) Get() {
+	if !this.Template.SetTemplateName(this.Context.GetPathVar("name")) {
+		this.Context.WriteString("error: " + this.Template.Err().Error())
+		return
+	}
+	this.Template.SetVar("User", "bob")
+}
+
+type SessionValuesHandler struct {
+	Handler
+}
+
+func (this *SessionValuesHandler) Get() {
+	s := this.Session
+	switch this.Context.GetQueryVar("step") {
+	case "1":
+		s.SetValue("int", 42)
+		s.SetValue("bool", true)
+		s.SetValue("list", []string{"a", "b"})
+		s.AddFlash("saved")
+		list := []string{}
+		s.GetValue("list", &list)
+		this.Context.WriteString(fmt.Sprintf("%d,%v,%v,%v", s.GetInt("int"), s.GetBool("bool"), list, s.Has("list")))
+	case "2":
+		this.Template.SetTemplateString(`{{range flashes}}<p>{{.}}</p>{{end}}`)
+	case "3":
+		s.Destroy()
+		this.Context.WriteString("destroyed")
+	case "4":
+		this.Context.WriteString(fmt.Sprint(s.Has("int")))
+	}
+}